@@ -0,0 +1,185 @@
+package slowsync
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// tempFilePrefix is the prefix of the names of files being written to
+// the destination; such files are left only if the process was killed.
+const tempFilePrefix = ".slowsync-tmp."
+
+const maxFileNameLength = 255
+
+var tempFileCounter uint64
+
+// cleanedTempFileDirs are the directories already checked for leftover
+// temporary files by cleanTempFilesInDir.
+var cleanedTempFileDirs sync.Map
+
+// atomicFile is a file written under a temporary name in the directory of
+// the destination path, and renamed to the destination path only on Commit.
+// Thus the destination path never has a partially written file.
+type atomicFile struct {
+	*os.File
+	dstPath string
+}
+
+// tempFileName returns a new name of a temporary file for the file name.
+func tempFileName(base string) string {
+	name := fmt.Sprintf("%s%d.%d.%s", tempFilePrefix, os.Getpid(), atomic.AddUint64(&tempFileCounter, 1), base)
+	if len(name) > maxFileNameLength {
+		name = name[:maxFileNameLength]
+	}
+	return name
+}
+
+func createAtomicFile(dstPath string) (*atomicFile, error) {
+	dir, base := filepath.Split(dstPath)
+	cleanTempFilesInDir(dir)
+	for {
+		f, err := os.OpenFile(filepath.Join(dir, tempFileName(base)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			// left by a killed process with the same PID
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &atomicFile{File: f, dstPath: dstPath}, nil
+	}
+}
+
+// commitOptions defines how to finish writing a destination file.
+type commitOptions struct {
+	// fsyncDir makes the rename to be flushed as well.
+	fsyncDir bool
+
+	// prepare (if set) is called with the path of the written file before
+	// it is flushed and renamed into place, to apply the metadata. Thus
+	// the destination path never has a file without its metadata.
+	prepare func(filePath string) error
+}
+
+// Commit flushes the file to the disk and renames it to the destination
+// path. If opts.prepare fails, then the file is aborted.
+func (f *atomicFile) Commit(opts commitOptions) error {
+	if opts.prepare != nil {
+		if err := opts.prepare(f.Name()); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+	if err := f.File.Sync(); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.dstPath); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if opts.fsyncDir {
+		return fsyncDirectory(filepath.Dir(f.dstPath))
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file.
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		log.Printf("unable to remove the temporary file '%s': %v", f.Name(), err)
+	}
+}
+
+func fsyncDirectory(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func isTempFile(filePath string) bool {
+	return strings.HasPrefix(filepath.Base(filePath), tempFilePrefix)
+}
+
+// cleanTempFilesInDir removes the temporary files left in the directory by
+// killed processes, when the directory is written to for the first time.
+// Unlike removeTempFiles it does not depend on the index, which could be
+// loaded from a cache made before the process was killed.
+func cleanTempFilesInDir(dir string) {
+	if _, loaded := cleanedTempFileDirs.LoadOrStore(filepath.Clean(dir), struct{}{}); loaded {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("unable to look for leftover temporary files in '%s': %v", dir, err)
+		return
+	}
+	// the temporary files of this process are being written right now
+	ownPrefix := fmt.Sprintf("%s%d.", tempFilePrefix, os.Getpid())
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, tempFilePrefix) || strings.HasPrefix(name, ownPrefix) {
+			continue
+		}
+		filePath := filepath.Join(dir, name)
+		if err := os.Remove(filePath); err != nil {
+			log.Printf("unable to remove the leftover temporary file '%s': %v", filePath, err)
+			continue
+		}
+		fmt.Println("removed leftover temporary file:", filePath)
+	}
+}
+
+// removeTempFiles removes the temporary files left on the destination by
+// killed processes, and forgets them.
+func (ft *fileTree) removeTempFiles(dryRun bool) {
+	var tempFiles []string
+	if ft.diskIndex {
+		nodes, err := ft.queryCachedNodes("WHERE path GLOB ?", "*"+tempFilePrefix+"*")
+		if err != nil {
+			log.Printf("unable to find leftover temporary files in the cache: %v", err)
+		}
+		for _, n := range nodes {
+			if isTempFile(n.path) {
+				tempFiles = append(tempFiles, n.path)
+			}
+		}
+	} else {
+		ft.nodeMapMutex.Lock()
+		for filePath := range ft.nodeMap {
+			if isTempFile(filePath) {
+				tempFiles = append(tempFiles, filePath)
+			}
+		}
+		ft.nodeMapMutex.Unlock()
+	}
+
+	for _, filePath := range tempFiles {
+		if dryRun {
+			if !ft.diskIndex {
+				// the disk index is the cache, it should not be changed by a dry run
+				ft.deleteNode(filePath)
+			}
+			continue
+		}
+		ft.deleteNode(filePath)
+		if err := os.Remove(filepath.Join(ft.rootPath, filePath)); err != nil {
+			log.Printf("unable to remove the leftover temporary file '%s': %v", filePath, err)
+			continue
+		}
+		fmt.Println("removed leftover temporary file:", filePath)
+	}
+}
@@ -0,0 +1,172 @@
+package slowsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTempFileName(t *testing.T) {
+	for _, base := range []string{"a", strings.Repeat("x", maxFileNameLength)} {
+		name := tempFileName(base)
+		if !isTempFile(name) {
+			t.Errorf("%q is not recognized as a temporary file", name)
+		}
+		if !strings.HasPrefix(name, fmt.Sprintf("%s%d.", tempFilePrefix, os.Getpid())) {
+			t.Errorf("%q does not have the PID in the prefix", name)
+		}
+		if len(name) > maxFileNameLength {
+			t.Errorf("%q is longer than %d", name, maxFileNameLength)
+		}
+		if len(base) < 10 && !strings.HasSuffix(name, "."+base) {
+			t.Errorf("%q does not end with the base name '%s'", name, base)
+		}
+		if other := tempFileName(base); other == name {
+			t.Errorf("got the same name %q twice", name)
+		}
+	}
+	if isTempFile("a/b" + tempFilePrefix) {
+		t.Errorf("a file with the prefix in the middle of the name is recognized as a temporary file")
+	}
+}
+
+func TestAtomicFile(t *testing.T) {
+	errPrepare := errors.New("prepare failed")
+	for _, tc := range []struct {
+		name            string
+		abort           bool
+		prepareErr      error
+		expectedErr     error
+		expectedContent string
+	}{
+		{
+			name:            "commit",
+			expectedContent: "new",
+		},
+		{
+			name:            "abort",
+			abort:           true,
+			expectedContent: "old",
+		},
+		{
+			name:            "failed prepare",
+			prepareErr:      errPrepare,
+			expectedErr:     errPrepare,
+			expectedContent: "old",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dstPath := filepath.Join(dir, "file")
+			if err := os.WriteFile(dstPath, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := createAtomicFile(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Dir(f.Name()) != dir || !isTempFile(f.Name()) {
+				t.Errorf("unexpected temporary file '%s'", f.Name())
+			}
+			if _, err := f.WriteString("new"); err != nil {
+				t.Fatal(err)
+			}
+			if content, _ := os.ReadFile(dstPath); string(content) != "old" {
+				t.Errorf("the destination is changed before the commit: %q", content)
+			}
+
+			if tc.abort {
+				f.Abort()
+			} else {
+				var preparedPath string
+				err = f.Commit(commitOptions{
+					fsyncDir: true,
+					prepare: func(filePath string) error {
+						preparedPath = filePath
+						return tc.prepareErr
+					},
+				})
+				if !errors.Is(err, tc.expectedErr) {
+					t.Errorf("got error %v, expected %v", err, tc.expectedErr)
+				}
+				if preparedPath != f.Name() {
+					t.Errorf("prepared '%s' instead of the temporary file '%s'", preparedPath, f.Name())
+				}
+			}
+
+			if content, _ := os.ReadFile(dstPath); string(content) != tc.expectedContent {
+				t.Errorf("got content %q, expected %q", content, tc.expectedContent)
+			}
+			if files := listTestDir(t, dir); !reflect.DeepEqual(files, []string{"file"}) {
+				t.Errorf("got files %q, expected only the destination file", files)
+			}
+		})
+	}
+}
+
+func TestCleanTempFilesInDir(t *testing.T) {
+	dir := t.TempDir()
+	ownTempFile := tempFileName("own")
+	foreignTempFile := fmt.Sprintf("%s%d.1.foreign", tempFilePrefix, os.Getpid()+1)
+	for _, name := range []string{"regular", ownTempFile, foreignTempFile} {
+		writeTestFile(t, dir, name, name)
+	}
+
+	cleanTempFilesInDir(dir)
+	expected := []string{ownTempFile, "regular"}
+	if files := listTestDir(t, dir); !reflect.DeepEqual(files, expected) {
+		t.Errorf("got files %q, expected %q", files, expected)
+	}
+
+	// a directory is cleaned only once
+	writeTestFile(t, dir, foreignTempFile, foreignTempFile)
+	cleanTempFilesInDir(dir)
+	expected = []string{foreignTempFile, ownTempFile, "regular"}
+	sort.Strings(expected)
+	if files := listTestDir(t, dir); !reflect.DeepEqual(files, expected) {
+		t.Errorf("got files %q, expected %q", files, expected)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	tempFile := "d/" + tempFilePrefix + "1.1.a"
+	paths := []string{"a", "d/b", tempFile}
+	for _, diskIndex := range []bool{false, true} {
+		for _, dryRun := range []bool{false, true} {
+			t.Run(fmt.Sprintf("diskIndex=%v/dryRun=%v", diskIndex, dryRun), func(t *testing.T) {
+				ft := newTestFileTree(t, paths, diskIndex)
+				ft.rootPath = t.TempDir()
+				for _, filePath := range paths {
+					writeTestFile(t, ft.rootPath, filePath, filePath)
+				}
+
+				ft.removeTempFiles(dryRun)
+
+				expectedFiles := []string{"a", "d/", "d/b"}
+				if dryRun {
+					expectedFiles = append(expectedFiles, tempFile)
+					sort.Strings(expectedFiles)
+				}
+				if files := listTestDir(t, ft.rootPath); !reflect.DeepEqual(files, expectedFiles) {
+					t.Errorf("got files %q, expected %q", files, expectedFiles)
+				}
+				// the disk index is the cache, which is not changed by a dry run
+				_, inIndex := ft.getNode(tempFile)
+				if expectedInIndex := dryRun && diskIndex; inIndex != expectedInIndex {
+					t.Errorf("the temporary file is in the index: %v, expected %v", inIndex, expectedInIndex)
+				}
+				for _, filePath := range []string{"a", "d/b"} {
+					if _, ok := ft.getNode(filePath); !ok {
+						t.Errorf("'%s' is removed from the index", filePath)
+					}
+				}
+			})
+		}
+	}
+}
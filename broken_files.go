@@ -0,0 +1,342 @@
+package slowsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	xerrors "github.com/xaionaro-go/errors"
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
+)
+
+var (
+	// ErrGetdentsLoop is reported when a directory listing returns the same entries again and again.
+	ErrGetdentsLoop = errors.New("got into a getdents loop")
+
+	// ErrDirectoryCycle is reported when a directory entry points to an already scanned directory.
+	ErrDirectoryCycle = errors.New("got into a directory cycle")
+)
+
+type BrokenFilePhase string
+
+const (
+	BrokenFilePhaseUndefined = BrokenFilePhase("")
+	BrokenFilePhaseScan      = BrokenFilePhase("scan")
+	BrokenFilePhaseLstat     = BrokenFilePhase("lstat")
+	BrokenFilePhaseOpen      = BrokenFilePhase("open")
+	BrokenFilePhaseRead      = BrokenFilePhase("read")
+	BrokenFilePhaseWrite     = BrokenFilePhase("write")
+)
+
+type BrokenFileClass string
+
+const (
+	BrokenFileClassOther        = BrokenFileClass("other")
+	BrokenFileClassEIO          = BrokenFileClass("EIO")
+	BrokenFileClassENOENT       = BrokenFileClass("ENOENT")
+	BrokenFileClassELOOP        = BrokenFileClass("ELOOP")
+	BrokenFileClassTimeout      = BrokenFileClass("timeout")
+	BrokenFileClassGetdentsLoop = BrokenFileClass("getdents loop")
+	BrokenFileClassCycle        = BrokenFileClass("directory cycle")
+	BrokenFileClassDestination  = BrokenFileClass("destination")
+	BrokenFileClassPartial      = BrokenFileClass("partially recovered")
+)
+
+// PhaseError is an error annotated with the phase of processing, where it happened.
+type PhaseError struct {
+	Phase BrokenFilePhase
+	Err   error
+}
+
+func withPhase(phase BrokenFilePhase, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PhaseError{Phase: phase, Err: err}
+}
+
+func (err *PhaseError) Error() string {
+	return fmt.Sprintf("unable to %s: %s", err.Phase, errorMessage(err.Err))
+}
+
+func (err *PhaseError) Unwrap() error {
+	return err.Err
+}
+
+// errorMessage returns the error message without stack traces, to fit into one line.
+func errorMessage(err error) string {
+	if xerr, ok := err.(*xerrors.Error); ok {
+		return xerr.WithFormat(xerrors.FormatOneLine).Error()
+	}
+	return err.Error()
+}
+
+func errorPhase(err error) BrokenFilePhase {
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		return phaseErr.Phase
+	}
+	return BrokenFilePhaseUndefined
+}
+
+func classifyError(err error) BrokenFileClass {
+	var (
+		errno      syscall.Errno
+		dupNameErr osrecovery.ErrDuplicateName
+		badRanges  ErrBadRanges
+	)
+	switch {
+	case errors.Is(err, osrecovery.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return BrokenFileClassTimeout
+	case errors.Is(err, ErrGetdentsLoop), errors.As(err, &dupNameErr), errors.Is(err, osrecovery.ErrTooManyEntries):
+		return BrokenFileClassGetdentsLoop
+	case errors.Is(err, ErrDirectoryCycle):
+		return BrokenFileClassCycle
+	case errors.As(err, &badRanges):
+		return BrokenFileClassPartial
+	case errorPhase(err) == BrokenFilePhaseWrite:
+		return BrokenFileClassDestination
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.EIO:
+			return BrokenFileClassEIO
+		case syscall.ENOENT:
+			return BrokenFileClassENOENT
+		case syscall.ELOOP:
+			return BrokenFileClassELOOP
+		}
+	}
+	return BrokenFileClassOther
+}
+
+// isFatalDestinationError returns true if the error means that
+// there is no sense to continue writing to the destination.
+func isFatalDestinationError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ENOSPC, syscall.EROFS, syscall.EDQUOT:
+		return true
+	}
+	return false
+}
+
+// BrokenFile is a record of the broken-files list.
+type BrokenFile struct {
+	Path      string          `json:"path"`
+	Class     BrokenFileClass `json:"class,omitempty"`
+	Errno     syscall.Errno   `json:"errno,omitempty"`
+	Phase     BrokenFilePhase `json:"phase,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	FirstSeen time.Time       `json:"first_seen"`
+	LastSeen  time.Time       `json:"last_seen"`
+	Attempts  uint            `json:"attempts"`
+}
+
+// brokenFilesList is the list of broken files, which (if enabled) is
+// persisted as JSON lines. Each update of a record is appended as a new
+// line, and the last line of a path wins while loading. Lines which are not
+// JSON objects are loaded as bare paths (the legacy format).
+type brokenFilesList struct {
+	locker        sync.Mutex
+	file          *os.File
+	path          string
+	entries       map[string]*BrokenFile
+	seenInSession map[string]bool
+}
+
+func newBrokenFilesList() *brokenFilesList {
+	return &brokenFilesList{
+		entries:       map[string]*BrokenFile{},
+		seenInSession: map[string]bool{},
+	}
+}
+
+func parseBrokenFileLine(line []byte) *BrokenFile {
+	if bytes.HasPrefix(line, []byte("{")) {
+		var entry BrokenFile
+		if err := json.Unmarshal(line, &entry); err == nil && entry.Path != "" {
+			return &entry
+		}
+	}
+	return &BrokenFile{Path: string(line)}
+}
+
+func (l *brokenFilesList) Open(path string) error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.path = path
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open '%s': %w", l.path, err)
+	}
+	l.file = f
+
+	scanner := bufio.NewScanner(l.file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := parseBrokenFileLine(scanner.Bytes())
+		l.entries[entry.Path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read '%s': %w", l.path, err)
+	}
+
+	return nil
+}
+
+func (l *brokenFilesList) Close() error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Entries returns a copy of all the records.
+func (l *brokenFilesList) Entries() []BrokenFile {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	result := make([]BrokenFile, 0, len(l.entries))
+	for _, entry := range l.entries {
+		result = append(result, *entry)
+	}
+	return result
+}
+
+// Remove deletes the records and rewrites the list file (if enabled),
+// because there is no way to remove a line from an append-only file.
+func (l *brokenFilesList) Remove(filePaths ...string) error {
+	if len(filePaths) == 0 {
+		return nil
+	}
+
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	for _, filePath := range filePaths {
+		delete(l.entries, filePath)
+	}
+	if l.file == nil {
+		return nil
+	}
+
+	tmpPath := l.path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("unable to create '%s': %w", tmpPath, err)
+	}
+	origFile := l.file
+	l.file = tmpFile
+	for _, entry := range l.entries {
+		if err := l.writeEntry(entry); err != nil {
+			l.file = origFile
+			tmpFile.Close()
+			return err
+		}
+	}
+	l.file = origFile
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("unable to close '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return fmt.Errorf("unable to rename '%s' to '%s': %w", tmpPath, l.path, err)
+	}
+	origFile.Close()
+
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open '%s': %w", l.path, err)
+	}
+	return nil
+}
+
+func (l *brokenFilesList) Has(filePath string) bool {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	_, ok := l.entries[filePath]
+	return ok
+}
+
+// Add records the failure. It returns false if the path was already
+// recorded during this session.
+func (l *brokenFilesList) Add(filePath string, fileErr error) (bool, error) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if l.seenInSession[filePath] {
+		return false, nil
+	}
+	l.seenInSession[filePath] = true
+
+	now := time.Now()
+	entry := l.entries[filePath]
+	if entry == nil {
+		entry = &BrokenFile{
+			Path:      filePath,
+			FirstSeen: now,
+		}
+		l.entries[filePath] = entry
+	}
+	if entry.FirstSeen.IsZero() {
+		entry.FirstSeen = now
+	}
+	entry.LastSeen = now
+	entry.Attempts++
+	entry.Class = classifyError(fileErr)
+	entry.Phase = errorPhase(fileErr)
+	entry.Errno = 0
+	errors.As(fileErr, &entry.Errno)
+	if fileErr != nil {
+		entry.Error = errorMessage(fileErr)
+	}
+
+	if l.file == nil {
+		return true, nil
+	}
+	return true, l.writeEntry(entry)
+}
+
+func (l *brokenFilesList) writeEntry(entry *BrokenFile) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to serialize the record about '%s': %w", entry.Path, err)
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("unable to write to '%s': %w", l.path, err)
+	}
+	return nil
+}
+
+func (ft *fileTree) SetBrokenFilesList(path string) error {
+	return ft.brokenFiles.Open(path)
+}
+
+func (ft *fileTree) addBrokenFile(filePath string, fileErr error) (bool, error) {
+	added, err := ft.brokenFiles.Add(filePath, fileErr)
+	if !added {
+		return false, nil
+	}
+	fmt.Println("broken file:", filePath, fileErr)
+	return true, err
+}
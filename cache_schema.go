@@ -0,0 +1,184 @@
+package slowsync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var (
+	// ErrCacheVersionTooNew is reported when the cache was made by a newer
+	// version of slowsync, which layout is unknown.
+	ErrCacheVersionTooNew = errors.New("the cache schema version is newer than supported")
+)
+
+// cacheMigration upgrades the cache DB by one version.
+type cacheMigration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// cacheMigrations are the migrations of the cache DB; the migration with
+// index N upgrades the DB from version N to version N+1. Only append new
+// migrations, never change the existing ones: there are caches of
+// multi-day scans in the wild.
+//
+// The caches made before schema_version was introduced have no version
+// and are upgraded from version 1, thus the migrations since version 1
+// should tolerate an already applied change.
+var cacheMigrations = []cacheMigration{
+	{"create file_tree", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS file_tree (path varchar(4096), size bigint)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS file_tree_idx_path ON file_tree (path)`,
+		)
+	}},
+	{"add modification times and digests", func(tx *sql.Tx) error {
+		return addCacheColumns(tx, "file_tree", "mtime bigint", "digest blob", "sampled_digest blob")
+	}},
+	{"add file types and inodes", func(tx *sql.Tx) error {
+		return addCacheColumns(tx, "file_tree", "mode integer", "dev bigint", "ino bigint", "nlink bigint", "rdev bigint")
+	}},
+	{"add the scan state", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS file_tree_meta (root_path varchar(4096), scan_started bigint, scan_finished bigint, complete integer)`,
+			`CREATE TABLE IF NOT EXISTS file_tree_dirs (path varchar(4096) PRIMARY KEY, listed integer)`,
+		)
+	}},
+	{"add directory times", func(tx *sql.Tx) error {
+		return addCacheColumns(tx, "file_tree_dirs", "mtime bigint", "ctime bigint")
+	}},
+	{"add directory completeness", func(tx *sql.Tx) error {
+		return addCacheColumns(tx, "file_tree_dirs", "complete integer")
+	}},
+}
+
+// cacheVersionScanState is the version, which introduced file_tree_meta.
+const cacheVersionScanState = 4
+
+// cacheSchemaVersion is the version of the cache DB layout this code works with.
+var cacheSchemaVersion = len(cacheMigrations)
+
+func execAll(tx *sql.Tx, queries ...string) error {
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("%s: %w", query, err)
+		}
+	}
+	return nil
+}
+
+func cacheTableColumns(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, table string) (map[string]bool, error) {
+	rows, err := q.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid          int
+			name, typ    string
+			notNull, pk  int
+			defaultValue interface{}
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// addCacheColumns adds the columns (in form "<name> <type>"), which are missing.
+func addCacheColumns(tx *sql.Tx, table string, columns ...string) error {
+	existing, err := cacheTableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if existing[strings.Fields(column)[0]] {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheVersion returns the version of the cache DB layout: zero for
+// an empty DB, and 1 for a cache made before the versioning was introduced.
+func (ft *fileTree) cacheVersion() (int, error) {
+	columns, err := cacheTableColumns(ft.cacheDB, "schema_version")
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		columns, err = cacheTableColumns(ft.cacheDB, "file_tree")
+		if err != nil {
+			return 0, err
+		}
+		if len(columns) == 0 {
+			return 0, nil
+		}
+		return 1, nil
+	}
+
+	var version int
+	if err := ft.cacheDB.QueryRow(`SELECT version FROM schema_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// migrateCache upgrades the cache DB to cacheSchemaVersion, and returns
+// the version it had (zero means the DB was empty).
+func (ft *fileTree) migrateCache() (int, error) {
+	version, err := ft.cacheVersion()
+	if err != nil {
+		return 0, err
+	}
+	if version > cacheSchemaVersion {
+		return version, fmt.Errorf("%w: %d > %d (the cache '%s' was made by a newer version of slowsync)",
+			ErrCacheVersionTooNew, version, cacheSchemaVersion, ft.cachePath)
+	}
+
+	for curVersion := version; curVersion < cacheSchemaVersion; curVersion++ {
+		migration := cacheMigrations[curVersion]
+		if version > 0 {
+			log.Printf("Upgrading the cache '%s' from version %d: %s", ft.cachePath, curVersion, migration.description)
+		}
+		tx, err := ft.cacheDB.Begin()
+		if err != nil {
+			return version, err
+		}
+		err = migration.apply(tx)
+		if err == nil {
+			err = setCacheVersion(tx, curVersion+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return version, fmt.Errorf("unable to upgrade the cache to version %d (%s): %w", curVersion+1, migration.description, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+func setCacheVersion(tx *sql.Tx, version int) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS schema_version (version integer)`,
+		`DELETE FROM schema_version`,
+		fmt.Sprintf(`INSERT INTO schema_version (version) VALUES (%d)`, version),
+	)
+}
@@ -0,0 +1,181 @@
+package slowsync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestCache(t *testing.T) *fileTree {
+	t.Helper()
+	ft := &fileTree{
+		cachePath: filepath.Join(t.TempDir(), "cache.db"),
+	}
+	var err error
+	ft.cacheDB, err = sql.Open("sqlite3", "file:"+ft.cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.cacheDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { ft.cacheDB.Close() })
+	return ft
+}
+
+func TestMigrateCache(t *testing.T) {
+	legacyFileTree := []string{
+		`CREATE TABLE file_tree (path varchar(4096), size bigint)`,
+		`CREATE UNIQUE INDEX file_tree_idx_path ON file_tree (path)`,
+		`INSERT INTO file_tree (path, size) VALUES ('a/b', 123)`,
+	}
+	for _, tc := range []struct {
+		name            string
+		setup           []string
+		expectedVersion int
+		expectedErr     error
+		expectedSize    int64 // of "a/b", zero if it should not exist
+	}{
+		{
+			name:            "empty",
+			expectedVersion: 0,
+		},
+		{
+			name:            "legacy",
+			setup:           legacyFileTree,
+			expectedVersion: 1,
+			expectedSize:    123,
+		},
+		{
+			name: "legacy with some columns already added",
+			setup: append(append([]string{}, legacyFileTree...),
+				`ALTER TABLE file_tree ADD COLUMN mtime bigint`,
+				`ALTER TABLE file_tree ADD COLUMN digest blob`,
+				`ALTER TABLE file_tree ADD COLUMN sampled_digest blob`,
+			),
+			expectedVersion: 1,
+			expectedSize:    123,
+		},
+		{
+			name: "versioned",
+			setup: append(append([]string{}, legacyFileTree...),
+				`ALTER TABLE file_tree ADD COLUMN mtime bigint`,
+				`ALTER TABLE file_tree ADD COLUMN digest blob`,
+				`ALTER TABLE file_tree ADD COLUMN sampled_digest blob`,
+				`CREATE TABLE schema_version (version integer)`,
+				`INSERT INTO schema_version (version) VALUES (2)`,
+			),
+			expectedVersion: 2,
+			expectedSize:    123,
+		},
+		{
+			name: "too new",
+			setup: []string{
+				`CREATE TABLE schema_version (version integer)`,
+				fmt.Sprintf(`INSERT INTO schema_version (version) VALUES (%d)`, cacheSchemaVersion+1),
+			},
+			expectedVersion: cacheSchemaVersion + 1,
+			expectedErr:     ErrCacheVersionTooNew,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ft := openTestCache(t)
+			for _, query := range tc.setup {
+				if _, err := ft.cacheDB.Exec(query); err != nil {
+					t.Fatalf("%s: %v", query, err)
+				}
+			}
+
+			version, err := ft.migrateCache()
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("got error %v, expected %v", err, tc.expectedErr)
+			}
+			if version != tc.expectedVersion {
+				t.Errorf("got previous version %d, expected %d", version, tc.expectedVersion)
+			}
+			if tc.expectedErr != nil {
+				return
+			}
+
+			// the second run has nothing to do
+			version, err = ft.migrateCache()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != cacheSchemaVersion {
+				t.Errorf("got version %d after the migration, expected %d", version, cacheSchemaVersion)
+			}
+
+			for table, columns := range map[string][]string{
+				"file_tree":      {"path", "size", "mtime", "digest", "sampled_digest", "mode", "dev", "ino", "nlink", "rdev"},
+				"file_tree_meta": {"root_path", "scan_started", "scan_finished", "complete"},
+				"file_tree_dirs": {"path", "listed", "mtime", "ctime", "complete"},
+			} {
+				existing, err := cacheTableColumns(ft.cacheDB, table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, column := range columns {
+					if !existing[column] {
+						t.Errorf("no column %s.%s after the migration", table, column)
+					}
+				}
+			}
+
+			nodes, err := ft.queryCachedNodes("WHERE path = ?", "a/b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tc.expectedSize == 0 && len(nodes) != 0:
+				t.Errorf("unexpected nodes %+v", nodes)
+			case tc.expectedSize != 0 && (len(nodes) != 1 || nodes[0].size != tc.expectedSize):
+				t.Errorf("got nodes %+v, expected a node with size %d", nodes, tc.expectedSize)
+			}
+		})
+	}
+}
+
+func TestGetCachedFileTreeLegacy(t *testing.T) {
+	rootPath := t.TempDir()
+	for _, filePath := range []string{"a", "b"} {
+		writeTestFile(t, rootPath, filePath, filePath)
+	}
+	legacy := openTestCache(t)
+	for _, query := range []string{
+		`CREATE TABLE file_tree (path varchar(4096), size bigint)`,
+		`INSERT INTO file_tree (path, size) VALUES ('a', 1)`,
+	} {
+		if _, err := legacy.cacheDB.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	legacy.cacheDB.Close()
+
+	ftI, err := GetCachedFileTree(rootPath, legacy.cachePath, 0, 16, ScanOptions{Incremental: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft := ftI.(*fileTree)
+	defer ft.cacheDB.Close()
+
+	// the cache is read as is, without rescanning
+	var paths []string
+	for n := range ft.nodeChan {
+		paths = append(paths, n.path)
+	}
+	if expected := []string{"a"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("got nodes %q, expected %q", paths, expected)
+	}
+
+	// the completeness of the scan is unknown
+	dst := newDiskTestFileTree(t, testFiles("a", "x"))
+	filesToDelete, err := ft.filesToDelete(dst.rootPath, dst, MirrorOptions{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesToDelete) != 0 {
+		t.Errorf("got files to delete %q, expected none", filesToDelete)
+	}
+}
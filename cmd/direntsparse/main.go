@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
+)
+
+func usage() {
+	fmt.Println("direntsparse [options] <dump file or dump dir> [...]")
+	os.Exit(int(syscall.EINVAL))
+}
+
+func panicIfError(err error) {
+	if err == nil {
+		return
+	}
+	panic(err)
+}
+
+func main() {
+	heuristicNames := make([]string, 0, len(osrecovery.DirentsHeuristics))
+	for _, heuristic := range osrecovery.DirentsHeuristics {
+		heuristicNames = append(heuristicNames, string(heuristic))
+	}
+	heuristicPtr := flag.String("heuristic", string(osrecovery.DirentsHeuristicScan), "how to parse the raw getdents64 output; possible values: "+strings.Join(heuristicNames, ", "))
+	allPtr := flag.Bool("all", false, "print duplicated names too")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	var dumpPaths []string
+	for _, arg := range args {
+		fileInfo, err := os.Stat(arg)
+		panicIfError(err)
+		if !fileInfo.IsDir() {
+			dumpPaths = append(dumpPaths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*"+osrecovery.DirentsDumpExt))
+		panicIfError(err)
+		dumpPaths = append(dumpPaths, matches...)
+	}
+
+	for _, dumpPath := range dumpPaths {
+		dump, err := osrecovery.ReadDirentsDump(dumpPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if dump.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: the listing of '%s' failed: %s\n", dumpPath, dump.Path, dump.Error)
+		}
+		if dump.Truncated {
+			fmt.Fprintf(os.Stderr, "%s: the dump of '%s' is truncated\n", dumpPath, dump.Path)
+		}
+
+		entries, err := dump.Entries(osrecovery.DirentsHeuristic(*heuristicPtr))
+		panicIfError(err)
+
+		seen := map[string]bool{}
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			if seen[entry.Name] && !*allPtr {
+				continue
+			}
+			seen[entry.Name] = true
+			fmt.Printf("%d\t%s\t%d\t%s\n", entry.Inode, entry.Type, entry.Offset, filepath.Join(dump.Path, entry.Name))
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/andy2046/maths"
 	"github.com/hashicorp/go-multierror"
 	"github.com/xaionaro-go/slowsync"
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
 )
 
 func usage() {
@@ -89,6 +90,15 @@ func main() {
 	precalculatedDigestsParsedFilePtr := flag.String("precalculated-digests-parsed-dir", "", "reuse parsed 'find <dir> -type f -exec sha256sum {} +' sqlite database")
 	sqlite3PathPtr := flag.String("sqlite3db", "", "enables storing the hash tree into an sqlite3 DB")
 	netPProfPtr := flag.String("net-pprof", "", "")
+	isolatedLstatPtr := flag.Bool("isolated-lstat", false, "call lstat() while scanning in helper processes, which are killed if a call hangs (see -lstat-timeout)")
+	lstatTimeoutPtr := flag.Duration("lstat-timeout", time.Minute, "the timeout of a single lstat() with -isolated-lstat (zero means no timeout)")
+	isolatedReadsPtr := flag.Bool("isolated-reads", false, "read the files in helper processes, which are killed if a read hangs (see -read-timeout)")
+	readTimeoutPtr := flag.Duration("read-timeout", time.Minute, "the timeout of a single read with -isolated-reads (zero means no timeout)")
+	listInactivityTimeoutPtr := flag.Duration("list-inactivity-timeout", time.Hour, "cancel listing a directory if no new names are received for this long")
+	listMaxDurationPtr := flag.Duration("list-max-duration", 0, "cancel listing a directory if it takes longer than this (zero means no limit)")
+	listMaxEntriesPtr := flag.Uint64("list-max-entries", 0, "cancel listing a directory if it returns more entries than this (zero means no limit)")
+	listDumpDirPtr := flag.String("list-dump-dir", "", "save the raw getdents64 output of every listed directory into this directory (see direntsparse)")
+	listMaxDuplicatesPtr := flag.Uint("list-max-duplicates", 10, "cancel listing a directory if the same name is returned more times than this")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) != 1 {
@@ -175,12 +185,27 @@ func main() {
 		}()
 	}
 
+	scanOptions := slowsync.ScanOptions{
+		IsolatedLstat: *isolatedLstatPtr,
+		LstatTimeout:  *lstatTimeoutPtr,
+		List: osrecovery.ListOptions{
+			InactivityTimeout: *listInactivityTimeoutPtr,
+			MaxEntries:        *listMaxEntriesPtr,
+			MaxDuplicates:     *listMaxDuplicatesPtr,
+			MaxDuration:       *listMaxDurationPtr,
+			DumpDir:           *listDumpDirPtr,
+		},
+	}
+
 	limits := slowsync.SetRLimits(1024*1024, 1024*1024*10)
 	log.Printf("RLimits: %#+v", limits)
 	debug.SetMaxThreads(int(limits.Cur) * 10)
 
-	fileTree, err := slowsync.GetFileTreeWrapper(dir, "", "", 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 5000))
+	fileTree, err := slowsync.GetFileTreeWrapper(dir, "", "", 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 5000), scanOptions)
 	panicIfError(err)
+	if *isolatedReadsPtr {
+		fileTree.SetIsolatedReads(*readTimeoutPtr)
+	}
 
 	for item := range fileTree.HashTree(newHasherFactory(digestsMapDB)) {
 		filePath := path.Clean(item.Path)
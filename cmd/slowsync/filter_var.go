@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/xaionaro-go/slowsync"
+)
+
+var _ flag.Value = (*filterVar)(nil)
+
+// filterVar adds rules to the filter in the order the flags are passed.
+type filterVar struct {
+	filter *slowsync.Filter
+	add    func(f *slowsync.Filter, value string) error
+}
+
+func (v filterVar) Set(in string) error {
+	return v.add(v.filter, in)
+}
+
+func (v filterVar) String() string {
+	return ""
+}
@@ -9,9 +9,11 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/andy2046/maths"
 	"github.com/xaionaro-go/slowsync"
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
 )
 
 func usage() {
@@ -28,9 +30,51 @@ func panicIfError(err error) {
 
 func main() {
 	dryRunPtr := flag.Bool("dry-run", false, "do not copy anything")
+	workersPtr := flag.Uint("workers", 16, "how many files to copy concurrently")
+	comparePtr := flag.String("compare", string(slowsync.ComparisonSize), "how to decide if a destination file is up to date; possible values: size, size+mtime (requires -preserve times), digest (of the whole content), sampled (digest of a few blocks)")
 	srcFileTreeCachePtr := flag.String("src-filetree-cache", "", "enables the file tree cache of the source and set the path where to store it")
+	srcFileTreeCacheIncrementalPtr := flag.Bool("src-filetree-cache-incremental", false, "refresh the complete file tree cache of the source by re-listing only the directories changed since the previous scan (by mtime and ctime); files modified in place are not noticed")
 	srcBrokenFilesPtr := flag.String("src-broken-files", "", "enables the list of broken files and set the path to it")
+	dstBrokenFilesPtr := flag.String("dst-broken-files", "", "enables the report of files failed to be written to the destination and set the path to it")
+	preservePtr := flag.String("preserve", "", "comma-separated metadata to copy: mode, owner (only as root), times, xattrs, acls, all")
+	fsyncDirsPtr := flag.Bool("fsync-dirs", false, "also fsync the directory of every written file after the file is renamed into place (the files themselves are always fsync-ed)")
+	symlinksPtr := flag.String("symlinks", string(slowsync.FileTypePolicyRecreate), "what to do with symlinks: recreate (as symlinks) or skip")
+	hardlinksPtr := flag.String("hardlinks", string(slowsync.FileTypePolicyRecreate), "what to do with hardlinked files: recreate (the links) or copy (as independent files)")
+	devicesPtr := flag.String("devices", string(slowsync.FileTypePolicySkip), "what to do with device nodes: skip or recreate (only as root)")
+	fifosPtr := flag.String("fifos", string(slowsync.FileTypePolicySkip), "what to do with FIFOs: skip or recreate")
+	socketsPtr := flag.String("sockets", string(slowsync.FileTypePolicySkip), "what to do with sockets: skip or recreate")
+	detectMovesPtr := flag.Bool("detect-moves", false, "find files moved on the source (by size and digest) and move (with -mirror) or hardlink them on the destination instead of copying")
+	srcHashTreeDBPtr := flag.String("src-hashtree-db", "", "with -detect-moves, take digests of the source files from this DB made by 'hashtree -sqlite3db' instead of reading the files")
+	dstHashTreeDBPtr := flag.String("dst-hashtree-db", "", "with -detect-moves, take digests of the destination files from this DB made by 'hashtree -sqlite3db' instead of reading the files")
 	dstFileTreeCachePtr := flag.String("dst-filetree-cache", "", "enables the file tree cache of the destination and set the path where to store it")
+	diskIndexPtr := flag.Bool("disk-index", false, "keep the indexes of the file trees only in their caches instead of the memory and compare the trees by a sorted merge-join, for trees with hundreds of millions of files (requires -src-filetree-cache and -dst-filetree-cache; not compatible with -detect-moves)")
+	dstFileTreeCacheIncrementalPtr := flag.Bool("dst-filetree-cache-incremental", false, "the same as -src-filetree-cache-incremental, but for the destination (and the excluded directories)")
+	salvagePtr := flag.Bool("salvage", false, "copy readable parts of files with unreadable blocks instead of skipping such files entirely")
+	salvageMinBlockSizePtr := flag.Int64("salvage-min-block-size", 512, "the smallest block to retry reading in the salvage mode")
+	salvageRetriesPtr := flag.Uint("salvage-retries", 0, "how many extra times to try to read a block of the smallest size in the salvage mode")
+	salvageHolesPtr := flag.Bool("salvage-holes", false, "leave holes instead of zeros in place of unreadable blocks in the salvage mode")
+	salvageMapPtr := flag.String("salvage-map", "", "enables the map of recovered and missing ranges of salvaged files and set the path to it; on the next run only the missing ranges are re-attempted")
+	isolatedLstatPtr := flag.Bool("isolated-lstat", false, "call lstat() while scanning in helper processes, which are killed if a call hangs (see -lstat-timeout)")
+	lstatTimeoutPtr := flag.Duration("lstat-timeout", time.Minute, "the timeout of a single lstat() with -isolated-lstat (zero means no timeout)")
+	isolatedReadsPtr := flag.Bool("isolated-reads", false, "read the source files in helper processes, which are killed if a read hangs (see -read-timeout)")
+	readTimeoutPtr := flag.Duration("read-timeout", time.Minute, "the timeout of a single read with -isolated-reads (zero means no timeout)")
+	listInactivityTimeoutPtr := flag.Duration("list-inactivity-timeout", time.Hour, "cancel listing a directory if no new names are received for this long")
+	listMaxDurationPtr := flag.Duration("list-max-duration", 0, "cancel listing a directory if it takes longer than this (zero means no limit)")
+	listMaxEntriesPtr := flag.Uint64("list-max-entries", 0, "cancel listing a directory if it returns more entries than this (zero means no limit)")
+	listDumpDirPtr := flag.String("list-dump-dir", "", "save the raw getdents64 output of every listed directory into this directory (see direntsparse)")
+	listMaxDuplicatesPtr := flag.Uint("list-max-duplicates", 10, "cancel listing a directory if the same name is returned more times than this")
+	mirrorPtr := flag.Bool("mirror", false, "delete files which exist only on the destination (except directories which were not scanned completely on the source)")
+	mirrorMaxDeletionsPtr := flag.Uint("mirror-max-deletions", 1000, "with -mirror, do not delete (and do not copy) anything if there are more files to delete than this (zero means no limit)")
+	mirrorTrashDirPtr := flag.String("mirror-trash-dir", "", "with -mirror, move the files into a dated subdirectory of this directory instead of deleting them")
+	retryBrokenFilesPtr := flag.Bool("retry-broken-files", false, "instead of syncing the whole tree, retry copying only the files from the list of broken files (see -src-broken-files) with progressively more careful strategies")
+	retryReadTimeoutPtr := flag.Duration("retry-read-timeout", 10*time.Second, "the timeout of a single read on the first retry strategy (it grows on the next strategies)")
+	retryCoolDownPtr := flag.Duration("retry-cooldown", time.Minute, "the pause before the second retry strategy (it grows before the next strategies)")
+	filter := slowsync.NewFilter()
+	flag.Var(filterVar{filter, (*slowsync.Filter).Exclude}, "exclude", "skip files matching the rsync-like pattern (may be repeated; the first matching -exclude/-include/-filter-from rule wins)")
+	flag.Var(filterVar{filter, (*slowsync.Filter).Include}, "include", "do not skip files matching the rsync-like pattern (may be repeated)")
+	flag.Var(filterVar{filter, (*slowsync.Filter).AddRulesFromFile}, "filter-from", "read '+ <pattern>' and '- <pattern>' rules from the file (may be repeated)")
+	var excludeDigests stringsVar
+	flag.Var(&excludeDigests, "exclude-digests", "skip source files with contents present in the hash tree (the text output of 'hashtree' or its -sqlite3db); may be repeated")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) < 2 {
@@ -40,9 +84,75 @@ func main() {
 	srcDir := args[0]
 	dstDir := args[1]
 
+	compare, err := slowsync.ParseComparison(*comparePtr)
+	panicIfError(err)
+	metadata, err := slowsync.ParseMetadataOptions(*preservePtr)
+	panicIfError(err)
+	if compare == slowsync.ComparisonSizeMTime && !metadata.Times {
+		// otherwise every destination file has the time of the copying, and is copied again on every run
+		panic("-compare size+mtime requires -preserve with times (or all)")
+	}
+	var fileTypes slowsync.FileTypeOptions
+	for _, policy := range []struct {
+		value  string
+		result *slowsync.FileTypePolicy
+	}{
+		{*symlinksPtr, &fileTypes.Symlinks},
+		{*hardlinksPtr, &fileTypes.Hardlinks},
+		{*devicesPtr, &fileTypes.Devices},
+		{*fifosPtr, &fileTypes.FIFOs},
+		{*socketsPtr, &fileTypes.Sockets},
+	} {
+		*policy.result, err = slowsync.ParseFileTypePolicy(policy.value)
+		panicIfError(err)
+	}
+	panicIfError(fileTypes.Validate())
+
+	if *retryBrokenFilesPtr {
+		if *srcBrokenFilesPtr == "" {
+			panic("-retry-broken-files requires -src-broken-files")
+		}
+		panicIfError(slowsync.RetryBrokenFiles(srcDir, dstDir, *srcBrokenFilesPtr, slowsync.RetryOptions{
+			DryRun:     *dryRunPtr,
+			Strategies: slowsync.DefaultRetryStrategies(*retryReadTimeoutPtr, *retryCoolDownPtr),
+			FsyncDirs:  *fsyncDirsPtr,
+			Metadata:   metadata,
+			SalvageMap: *salvageMapPtr,
+		}))
+		log.Println("end")
+		return
+	}
+
+	if *diskIndexPtr {
+		if *srcFileTreeCachePtr == "" || *dstFileTreeCachePtr == "" {
+			panic("-disk-index requires -src-filetree-cache and -dst-filetree-cache")
+		}
+		if *detectMovesPtr {
+			panic("-disk-index is not compatible with -detect-moves")
+		}
+	}
+
 	var wg sync.WaitGroup
 	var srcFileTree, dstFileTree slowsync.FileTree
 
+	scanOptions := slowsync.ScanOptions{
+		IsolatedLstat: *isolatedLstatPtr,
+		LstatTimeout:  *lstatTimeoutPtr,
+		List: osrecovery.ListOptions{
+			InactivityTimeout: *listInactivityTimeoutPtr,
+			MaxEntries:        *listMaxEntriesPtr,
+			MaxDuplicates:     *listMaxDuplicatesPtr,
+			MaxDuration:       *listMaxDurationPtr,
+			DumpDir:           *listDumpDirPtr,
+		},
+		Filter:    filter,
+		DiskIndex: *diskIndexPtr,
+	}
+	srcScanOptions := scanOptions
+	srcScanOptions.Incremental = *srcFileTreeCacheIncrementalPtr
+	dstScanOptions := scanOptions
+	dstScanOptions.Incremental = *dstFileTreeCacheIncrementalPtr
+
 	limits := slowsync.SetRLimits(1024*1024, 1024*1024*10)
 	log.Printf("RLimits: %#+v", limits)
 	debug.SetMaxThreads(int(limits.Cur) * 10)
@@ -51,15 +161,21 @@ func main() {
 	go func() {
 		defer wg.Done()
 		var err error
-		srcFileTree, err = slowsync.GetFileTreeWrapper(srcDir, *srcFileTreeCachePtr, *srcBrokenFilesPtr, 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 15000))
+		srcFileTree, err = slowsync.GetFileTreeWrapper(srcDir, *srcFileTreeCachePtr, *srcBrokenFilesPtr, 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 15000), srcScanOptions)
 		panicIfError(err)
+		if *salvageMapPtr != "" {
+			panicIfError(srcFileTree.SetSalvageMap(*salvageMapPtr))
+		}
+		if *isolatedReadsPtr {
+			srcFileTree.SetIsolatedReads(*readTimeoutPtr)
+		}
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		var err error
-		dstFileTree, err = slowsync.GetFileTreeWrapper(dstDir, *dstFileTreeCachePtr, "", 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 5000))
+		dstFileTree, err = slowsync.GetFileTreeWrapper(dstDir, *dstFileTreeCachePtr, *dstBrokenFilesPtr, 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 5000), dstScanOptions)
 		panicIfError(err)
 	}()
 
@@ -72,7 +188,7 @@ func main() {
 			if *dstFileTreeCachePtr != "" {
 				cachePath = *dstFileTreeCachePtr + "-" + strings.ReplaceAll(arg, "/", "-")
 			}
-			fileTree, err := slowsync.GetFileTreeWrapper(arg, cachePath, "", 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 15000))
+			fileTree, err := slowsync.GetFileTreeWrapper(arg, cachePath, "", 0, maths.Uint64Var.Min(limits.Cur/uint64(len(os.Args))-480, 15000), dstScanOptions)
 			panicIfError(err)
 			excludeFTChan <- fileTree
 		}(arg)
@@ -86,6 +202,46 @@ func main() {
 		excludeFTs = append(excludeFTs, ch)
 	}
 
-	panicIfError(srcFileTree.SyncTo(dstFileTree, excludeFTs, *dryRunPtr))
+	result, err := srcFileTree.SyncTo(dstFileTree, excludeFTs, slowsync.SyncOptions{
+		DryRun:  *dryRunPtr,
+		Workers: *workersPtr,
+		Compare: compare,
+		Salvage: slowsync.SalvageOptions{
+			Enabled:      *salvagePtr,
+			MinBlockSize: *salvageMinBlockSizePtr,
+			Retries:      *salvageRetriesPtr,
+			LeaveHoles:   *salvageHolesPtr,
+		},
+		Mirror: slowsync.MirrorOptions{
+			Enabled:      *mirrorPtr,
+			MaxDeletions: *mirrorMaxDeletionsPtr,
+			TrashDir:     *mirrorTrashDirPtr,
+		},
+		ExcludeDigests: excludeDigests,
+		Metadata:       metadata,
+		FileTypes:      fileTypes,
+		FsyncDirs:      *fsyncDirsPtr,
+		Moves: slowsync.MoveOptions{
+			Enabled:       *detectMovesPtr,
+			SrcHashTreeDB: *srcHashTreeDBPtr,
+			DstHashTreeDB: *dstHashTreeDBPtr,
+		},
+	})
+	log.Printf("copied: %d, moved: %d, linked: %d, skipped: %d, failed: %d, bytes: %d", result.Copied, result.Moved, result.Linked, result.Skipped, result.Failed, result.Bytes)
+	if err != nil {
+		log.Println("unable to sync:", err)
+	}
+	if code := exitCode(result, err); code != 0 {
+		os.Exit(code)
+	}
 	log.Println("end")
 }
+
+// exitCode returns the exit status of the sync: 1 if it failed or some
+// files were not synced, 0 otherwise.
+func exitCode(result slowsync.SyncResult, err error) int {
+	if err != nil || result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
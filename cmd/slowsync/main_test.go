@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/xaionaro-go/slowsync"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		result   slowsync.SyncResult
+		err      error
+		expected int
+	}{
+		{
+			name:     "nothing to do",
+			expected: 0,
+		},
+		{
+			name:     "copied and skipped",
+			result:   slowsync.SyncResult{Copied: 1, Moved: 1, Linked: 1, Skipped: 1},
+			expected: 0,
+		},
+		{
+			name:     "failed files",
+			result:   slowsync.SyncResult{Copied: 1, Failed: 1},
+			expected: 1,
+		},
+		{
+			name:     "failed sync",
+			err:      errors.New("unable to sync"),
+			expected: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := exitCode(tc.result, tc.err); code != tc.expected {
+				t.Errorf("got exit code %d, expected %d", code, tc.expected)
+			}
+		})
+	}
+}
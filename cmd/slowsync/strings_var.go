@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var _ flag.Value = (*stringsVar)(nil)
+
+// stringsVar collects the values of a repeated flag.
+type stringsVar []string
+
+func (v *stringsVar) Set(in string) error {
+	*v = append(*v, in)
+	return nil
+}
+
+func (v stringsVar) String() string {
+	return strings.Join(v, ",")
+}
@@ -62,7 +62,7 @@ func main() {
 		hasher = sha512.New()
 	}
 
-	fileTree, err := slowsync.GetFileTreeWrapper(dir, "", "", 1, 1)
+	fileTree, err := slowsync.GetFileTreeWrapper(dir, "", "", 1, 1, slowsync.ScanOptions{})
 	panicIfError(err)
 
 	err = fileTree.SplitList(hasher, levels, perms, *skipFirstCharsPtr)
@@ -0,0 +1,188 @@
+package slowsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sampleBlockCount = 16
+	sampleBlockSize  = 64 * 1024
+)
+
+// Comparison is the way to decide if a destination file is up to date.
+type Comparison string
+
+const (
+	// ComparisonSize considers files with equal sizes as equal.
+	ComparisonSize = Comparison("size")
+
+	// ComparisonSizeMTime considers files with equal sizes and modification times as equal.
+	// It makes sense only with MetadataOptions.Times, otherwise the destination
+	// files have the time of the copying.
+	ComparisonSizeMTime = Comparison("size+mtime")
+
+	// ComparisonDigest compares SHA256 digests of the whole contents.
+	ComparisonDigest = Comparison("digest")
+
+	// ComparisonSampled compares SHA256 digests of a few blocks spread
+	// over the file, which is much cheaper than ComparisonDigest for huge files.
+	ComparisonSampled = Comparison("sampled")
+)
+
+// comparator decides if the destination file is up to date with the source one.
+type comparator interface {
+	IsEqual(src *fileTree, srcNode node, dst *fileTree, dstNode node) bool
+}
+
+var comparators = map[Comparison]comparator{
+	"":                  comparatorSize{},
+	ComparisonSize:      comparatorSize{},
+	ComparisonSizeMTime: comparatorSizeMTime{},
+	ComparisonDigest:    comparatorDigest{kind: digestKindFull},
+	ComparisonSampled:   comparatorDigest{kind: digestKindSampled},
+}
+
+// Comparisons returns the supported comparisons.
+func Comparisons() []Comparison {
+	return []Comparison{ComparisonSize, ComparisonSizeMTime, ComparisonDigest, ComparisonSampled}
+}
+
+// ParseComparison parses the name of a comparison (see Comparisons).
+func ParseComparison(s string) (Comparison, error) {
+	c := Comparison(strings.ToLower(s))
+	if _, ok := comparators[c]; !ok || c == "" {
+		return "", fmt.Errorf("unknown comparison '%s'", s)
+	}
+	return c, nil
+}
+
+func (c Comparison) comparator() comparator {
+	if result, ok := comparators[c]; ok {
+		return result
+	}
+	return comparatorSize{}
+}
+
+type comparatorSize struct{}
+
+func (comparatorSize) IsEqual(_ *fileTree, srcNode node, _ *fileTree, dstNode node) bool {
+	return srcNode.size == dstNode.size
+}
+
+type comparatorSizeMTime struct{}
+
+func (comparatorSizeMTime) IsEqual(_ *fileTree, srcNode node, _ *fileTree, dstNode node) bool {
+	return srcNode.size == dstNode.size && srcNode.modTime == dstNode.modTime
+}
+
+type comparatorDigest struct {
+	kind digestKind
+}
+
+func (c comparatorDigest) IsEqual(src *fileTree, srcNode node, dst *fileTree, dstNode node) bool {
+	if srcNode.size != dstNode.size {
+		return false
+	}
+
+	srcDigest, err := src.nodeDigest(srcNode, c.kind)
+	if err != nil {
+		// the copying is going to fail the same way and report the file
+		log.Printf("unable to calculate the digest of the source file '%s': %v", srcNode.path, err)
+		return false
+	}
+	dstDigest, err := dst.nodeDigest(dstNode, c.kind)
+	if err != nil {
+		log.Printf("unable to calculate the digest of the destination file '%s': %v", dstNode.path, err)
+		return false
+	}
+	return bytes.Equal(srcDigest, dstDigest)
+}
+
+type digestKind int
+
+const (
+	digestKindFull = digestKind(iota)
+	digestKindSampled
+)
+
+// nodeDigest returns the digest of the file, it is calculated only once
+// (and is stored in the cache, if it is enabled).
+func (ft *fileTree) nodeDigest(n node, kind digestKind) ([]byte, error) {
+	if cached, ok := ft.getNode(n.path); ok {
+		n = cached
+	}
+
+	var digest []byte
+	var err error
+	switch kind {
+	case digestKindFull:
+		if n.digest != nil {
+			return n.digest, nil
+		}
+		digest, err = ft.fileDigest(n.path, sha256.New())
+		n.digest = digest
+	case digestKindSampled:
+		if n.sampledDigest != nil {
+			return n.sampledDigest, nil
+		}
+		digest, err = ft.sampledFileDigest(n.path, n.size, sha256.New())
+		n.sampledDigest = digest
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ft.setNode(n)
+	ft.updateCachedDigests(n)
+	return digest, nil
+}
+
+// fileDigest hashes the whole content of the file.
+func (ft *fileTree) fileDigest(filePath string, hasher hash.Hash) ([]byte, error) {
+	f, err := ft.openSourceFile(filepath.Join(ft.rootPath, filePath))
+	if err != nil {
+		return nil, withPhase(BrokenFilePhaseOpen, err)
+	}
+	defer f.Close()
+
+	hasher.Reset()
+	if _, err := io.Copy(hasher, newSequentialReader(f)); err != nil {
+		return nil, withPhase(BrokenFilePhaseRead, err)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// sampledFileDigest hashes the size and sampleBlockCount blocks evenly
+// spread over the file (including the first and the last ones).
+func (ft *fileTree) sampledFileDigest(filePath string, size int64, hasher hash.Hash) ([]byte, error) {
+	if size <= sampleBlockCount*sampleBlockSize {
+		return ft.fileDigest(filePath, hasher)
+	}
+
+	f, err := ft.openSourceFile(filepath.Join(ft.rootPath, filePath))
+	if err != nil {
+		return nil, withPhase(BrokenFilePhaseOpen, err)
+	}
+	defer f.Close()
+
+	hasher.Reset()
+	binary.Write(hasher, binary.LittleEndian, size)
+	buf := make([]byte, sampleBlockSize)
+	step := (size - sampleBlockSize) / (sampleBlockCount - 1)
+	for idx := int64(0); idx < sampleBlockCount; idx++ {
+		n, err := f.ReadAt(buf, idx*step)
+		if err != nil && !(err == io.EOF && n == len(buf)) {
+			return nil, withPhase(BrokenFilePhaseRead, err)
+		}
+		hasher.Write(buf[:n])
+	}
+	return hasher.Sum(nil), nil
+}
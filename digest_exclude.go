@@ -0,0 +1,180 @@
+package slowsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// sqliteHeader is the beginning of every SQLite database file.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// digestSet is a set of known contents, which should not be copied.
+type digestSet interface {
+	// HasSize returns false if there are no contents of the size, it is
+	// used to avoid hashing files which could not match anyway.
+	HasSize(size int64) bool
+
+	HasDigest(size int64, digest []byte) (bool, error)
+
+	Close() error
+}
+
+// openDigestSet opens a hash tree made by "hashtree": either its text
+// output or its SQLite DB (see -sqlite3db). The hash tree is expected
+// to be calculated with SHA256 (which is the default).
+func openDigestSet(filePath string) (digestSet, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err == nil && bytes.Equal(header, sqliteHeader) {
+		db, err := openHashTreeDB(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return newDBDigestSet(db)
+	}
+	return loadTextDigestSet(filePath)
+}
+
+type textDigestSet map[int64]map[string]struct{}
+
+func loadTextDigestSet(filePath string) (textDigestSet, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := textDigestSet{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "hash\t") {
+			continue
+		}
+		item, err := ParseHashTreeItem(line)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse line '%s' of '%s': %w", line, filePath, err)
+		}
+		size := int64(item.Size)
+		if result[size] == nil {
+			result[size] = map[string]struct{}{}
+		}
+		result[size][string(item.Digest)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read '%s': %w", filePath, err)
+	}
+	return result, nil
+}
+
+func (set textDigestSet) HasSize(size int64) bool {
+	return len(set[size]) > 0
+}
+
+func (set textDigestSet) HasDigest(size int64, digest []byte) (bool, error) {
+	_, ok := set[size][string(digest)]
+	return ok, nil
+}
+
+func (set textDigestSet) Close() error {
+	return nil
+}
+
+type dbDigestSet struct {
+	*hashTreeDB
+	sizes map[int64]struct{}
+}
+
+func newDBDigestSet(db *hashTreeDB) (*dbDigestSet, error) {
+	sizes, err := db.Sizes()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &dbDigestSet{
+		hashTreeDB: db,
+		sizes:      sizes,
+	}, nil
+}
+
+func (set *dbDigestSet) HasSize(size int64) bool {
+	_, ok := set.sizes[size]
+	return ok
+}
+
+func (set *dbDigestSet) HasDigest(size int64, digest []byte) (bool, error) {
+	paths, err := set.PathsByDigest(digest, size)
+	return len(paths) > 0, err
+}
+
+// digestExcluder skips source files, which contents are already present
+// in any of the digest sets.
+type digestExcluder struct {
+	sets []digestSet
+}
+
+func openDigestExcluder(filePaths []string) (*digestExcluder, error) {
+	e := &digestExcluder{}
+	for _, filePath := range filePaths {
+		set, err := openDigestSet(filePath)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("unable to open the hash tree '%s': %w", filePath, err)
+		}
+		e.sets = append(e.sets, set)
+	}
+	return e, nil
+}
+
+func (e *digestExcluder) Close() error {
+	for _, set := range e.sets {
+		set.Close()
+	}
+	return nil
+}
+
+// IsExcluded returns true if the content of the file is present in any
+// of the sets. Empty files are never excluded.
+func (e *digestExcluder) IsExcluded(ft *fileTree, n node) bool {
+	if n.size == 0 {
+		return false
+	}
+	var candidates []digestSet
+	for _, set := range e.sets {
+		if set.HasSize(n.size) {
+			candidates = append(candidates, set)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	digest, err := ft.nodeDigest(n, digestKindFull)
+	if err != nil {
+		// the copying is going to fail the same way and report the file
+		log.Printf("unable to calculate the digest of the source file '%s': %v", n.path, err)
+		return false
+	}
+	for _, set := range candidates {
+		found, err := set.HasDigest(n.size, digest)
+		if err != nil {
+			log.Printf("unable to look up the digest of '%s': %v", n.path, err)
+			continue
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
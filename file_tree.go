@@ -1,7 +1,6 @@
 package slowsync
 
 import (
-	"bufio"
 	"context"
 	"database/sql"
 	"encoding/hex"
@@ -14,61 +13,145 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/xaionaro-go/errors"
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
 	"golang.org/x/sync/semaphore"
 )
 
 type node struct {
-	path string
-	size int64
+	path    string
+	size    int64
+	modTime int64 // in nanoseconds since the Unix epoch
+
+	// mode is the type and the permissions of the file (zero means
+	// a regular file, for caches made by older versions)
+	mode  os.FileMode
+	dev   uint64
+	ino   uint64
+	nlink uint64
+	rdev  uint64 // the device number, if the file is a device node
+
+	// digests are calculated on demand (see nodeDigest)
+	digest        []byte
+	sampledDigest []byte
+}
+
+func newNode(path string, fileInfo os.FileInfo) node {
+	n := node{
+		path:    path,
+		size:    fileInfo.Size(),
+		modTime: fileInfo.ModTime().UnixNano(),
+		mode:    fileInfo.Mode(),
+	}
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		n.dev = uint64(stat.Dev)
+		n.ino = stat.Ino
+		n.nlink = uint64(stat.Nlink)
+		n.rdev = uint64(stat.Rdev)
+	}
+	return n
 }
 
 type fileTree struct {
-	rootPath string
+	rootPath    string
+	scanOptions ScanOptions
 
 	nodeChan     chan node
 	nodeMap      map[string]node
 	nodeMapMutex sync.Mutex
 	semaphore    *semaphore.Weighted
 
+	// diskIndex means nodeMap is not used, and the nodes are looked up
+	// in the cache instead (see ScanOptions.DiskIndex)
+	diskIndex bool
+
 	scanWg sync.WaitGroup
 
+	visitedDirs       map[inodeID]string
+	visitedDirsLocker sync.Mutex
+
+	// mountPoints are the mount points under rootPath (relative to it),
+	// nil if they are unknown (see isPossibleMountPoint)
+	mountPoints     map[string]struct{}
+	mountPointsOnce sync.Once
+
+	listedDirs       map[string]bool
+	listedDirsLocker sync.Mutex
+
+	// cachedListedDirs are the directories listed by the interrupted scan
+	// being resumed or the unchanged ones (see rescan)
+	cachedListedDirs map[string]struct{}
+
 	cachePath       string
 	cacheDB         *sql.DB
 	cacheDBTX       *sql.Tx
 	cacheDBTXLocker sync.Mutex
 
-	brokenFilesList     *os.File
-	brokenFilesListPath string
-	brokenFilesMap      map[string]bool
-	brokenFilesMapMutex sync.Mutex
+	brokenFiles *brokenFilesList
+
+	salvageMap *salvageMap
+
+	isolatedReads *osrecovery.OpenOptions
 }
 
 type FileTree interface {
-	SyncTo(FileTree, []FileTree, bool) error
+	SyncTo(FileTree, []FileTree, SyncOptions) (SyncResult, error)
 	HashTree(func() hash.Hash) chan HashTreeItem
 	SetBrokenFilesList(path string) error
+	SetSalvageMap(path string) error
+	SetIsolatedReads(readTimeout time.Duration)
 	SplitList(hasher hash.Hash, levels uint, perm os.FileMode, skipChars uint) error
 }
 
-func GetFileTree(dir string, maxDepth uint, maxOpenFiles uint64) (FileTree, error) {
+type ScanOptions struct {
+	// IsolatedLstat makes lstat() calls to be done by helper processes,
+	// which are killed if a call takes longer than LstatTimeout (zero means
+	// no timeout).
+	IsolatedLstat bool
+	LstatTimeout  time.Duration
+
+	// List defines when listing a directory is considered broken.
+	List osrecovery.ListOptions
+
+	// Filter defines which files to scan and to sync (nil means all of them).
+	Filter *Filter
+
+	// Incremental makes a complete cache (see GetCachedFileTree) to be
+	// refreshed: the directories changed since they were listed are listed
+	// again. Otherwise the cache is used as is.
+	Incremental bool
+
+	// DiskIndex makes the index of the nodes to be kept only in the cache
+	// instead of the memory (it requires the cache), and makes SyncTo to
+	// compare the trees by a sorted merge-join. It is slower, but the memory
+	// usage does not grow with the amount of files.
+	DiskIndex bool
+}
+
+func GetFileTree(dir string, maxDepth uint, maxOpenFiles uint64, opts ScanOptions) (FileTree, error) {
+	if opts.DiskIndex {
+		return nil, ErrDiskIndexWithoutCache
+	}
 	var err error
 	dir, err = filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 	ft := &fileTree{
-		rootPath:       dir,
-		nodeChan:       make(chan node, 1024),
-		nodeMap:        map[string]node{},
-		brokenFilesMap: map[string]bool{},
-		semaphore:      semaphore.NewWeighted(int64(maxOpenFiles)),
+		rootPath:    dir,
+		scanOptions: opts,
+		nodeChan:    make(chan node, 1024),
+		nodeMap:     map[string]node{},
+		brokenFiles: newBrokenFilesList(),
+		semaphore:   semaphore.NewWeighted(int64(maxOpenFiles)),
 	}
-	ft.backgroundScan(maxDepth)
+	ft.backgroundScan(maxDepth, []string{ft.rootPath})
 	return ft, nil
 }
 
@@ -112,17 +195,14 @@ func (ft *fileTree) HashTree(
 					}
 
 					if digest == nil {
-						f, err := os.Open(path)
+						digest, err = ft.fileDigest(srcNode.path, hasher)
 						if err != nil {
 							result <- HashTreeItem{
 								Path:  srcNode.path,
-								Error: fmt.Errorf("unable to open(): %w", err),
+								Error: err,
 							}
 							continue
 						}
-						io.Copy(hasher, f)
-						f.Close()
-						digest = hasher.Sum(nil)
 					}
 
 					item := HashTreeItem{
@@ -148,24 +228,21 @@ func (ft *fileTree) HashTree(
 	return result
 }
 
-func GetCachedFileTree(dir, cachePath string, maxDepth uint, maxOpenFiles uint64) (FileTree, error) {
+func GetCachedFileTree(dir, cachePath string, maxDepth uint, maxOpenFiles uint64, opts ScanOptions) (FileTree, error) {
 	var err error
 	dir, err = filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 	ft := &fileTree{
-		rootPath:       dir,
-		cachePath:      cachePath,
-		nodeChan:       make(chan node, 1024),
-		nodeMap:        map[string]node{},
-		brokenFilesMap: map[string]bool{},
-		semaphore:      semaphore.NewWeighted(int64(maxOpenFiles)),
-	}
-
-	hasCache := true
-	if _, err := os.Stat(ft.cachePath); os.IsNotExist(err) {
-		hasCache = false
+		rootPath:    dir,
+		scanOptions: opts,
+		cachePath:   cachePath,
+		nodeChan:    make(chan node, 1024),
+		nodeMap:     map[string]node{},
+		diskIndex:   opts.DiskIndex,
+		brokenFiles: newBrokenFilesList(),
+		semaphore:   semaphore.NewWeighted(int64(maxOpenFiles)),
 	}
 
 	ft.cacheDB, err = sql.Open("sqlite3", "file:"+ft.cachePath+"?cache=shared")
@@ -174,54 +251,167 @@ func GetCachedFileTree(dir, cachePath string, maxDepth uint, maxOpenFiles uint64
 	}
 	ft.cacheDB.SetMaxOpenConns(1)
 
-	if hasCache {
-		go func() {
-			log.Println("Reading the cache from", ft.cachePath)
-			err = ft.readCache()
-			log.Println("Reading the cache from", ft.cachePath, "-- complete")
-			close(ft.nodeChan)
-		}()
-	} else {
-		_, err = ft.cacheDB.Exec(`CREATE TABLE file_tree (path varchar(4096), size bigint)`)
+	prevVersion, err := ft.migrateCache()
+	if err != nil {
+		return nil, err
+	}
+
+	var state *cacheScanState
+	if prevVersion > 0 {
+		state, err = ft.readCacheScanState()
 		if err != nil {
-			return nil, errors.New(err)
+			return nil, err
 		}
-		_, err = ft.cacheDB.Exec(`CREATE UNIQUE INDEX file_tree_idx_path ON file_tree (path)`)
-		if err != nil {
-			return nil, errors.New(err)
+		if state != nil {
+			if err := state.checkRoot(ft.rootPath); err != nil {
+				return nil, err
+			}
 		}
-		ft.backgroundScan(maxDepth)
 	}
-	if err != nil {
-		return nil, errors.New(err)
+
+	switch {
+	case prevVersion == 0 || (state == nil && prevVersion >= cacheVersionScanState):
+		// a new cache (or the scan was not even started)
+		if err := ft.startCacheScan(); err != nil {
+			return nil, err
+		}
+		ft.backgroundScan(maxDepth, []string{ft.rootPath})
+	case state != nil && !state.complete:
+		log.Println("The scan started at", state.scanStarted, "was interrupted, resuming it")
+		if err := ft.resumeScan(maxDepth); err != nil {
+			return nil, errors.Wrap(err, "unable to resume the scan")
+		}
+	case state == nil:
+		// a cache made by an older version, which did not store the state
+		// of the scan, thus it is unknown if the scan was complete; the
+		// directories are not marked as listed, so the mirror mode does
+		// not delete anything (see filesToDelete)
+		log.Printf("WARNING: the cache %s was made by an older version, it is unknown if its scan was complete; "+
+			"nothing is going to be deleted in the mirror mode; remove the cache to rescan", ft.cachePath)
+		if ft.scanOptions.Incremental {
+			log.Printf("WARNING: the incremental scan is ignored for the cache %s: it has no state of the scan", ft.cachePath)
+		}
+		ft.backgroundReadCache()
+	case ft.scanOptions.Incremental:
+		if err := ft.refreshScan(maxDepth); err != nil {
+			return nil, errors.Wrap(err, "unable to refresh the scan")
+		}
+	default:
+		// a complete scan
+		ft.backgroundReadCache()
 	}
 
 	return ft, nil
 }
 
+// backgroundReadCache sends the nodes of the cache to nodeChan.
+func (ft *fileTree) backgroundReadCache() {
+	go func() {
+		log.Println("Reading the cache from", ft.cachePath)
+		err := ft.readCache()
+		if err != nil {
+			log.Println("unable to read the cache:", err)
+		}
+		log.Println("Reading the cache from", ft.cachePath, "-- complete")
+		close(ft.nodeChan)
+	}()
+}
+
+// updateCachedDigests stores the calculated digests of the node to the cache (if enabled).
+func (ft *fileTree) updateCachedDigests(node node) {
+	if ft.cacheDB == nil {
+		return
+	}
+	query := `UPDATE file_tree SET digest = ?, sampled_digest = ? WHERE path = ?`
+	var err error
+	ft.cacheDBTXLocker.Lock()
+	if ft.cacheDBTX != nil {
+		// the only connection is taken by the transaction of the scan
+		_, err = ft.cacheDBTX.Exec(query, node.digest, node.sampledDigest, node.path)
+	} else {
+		_, err = ft.cacheDB.Exec(query, node.digest, node.sampledDigest, node.path)
+	}
+	ft.cacheDBTXLocker.Unlock()
+	if err != nil {
+		log.Printf("unable to store the digest of '%s' to the cache: %v", node.path, err)
+	}
+}
+
 func (ft *fileTree) readCache() error {
-	rows, err := ft.cacheDB.Query("SELECT path, size FROM file_tree")
+	return ft.forEachCachedNode(func(node node) error {
+		ft.nodeChan <- node
+		ft.setNode(node)
+		return nil
+	})
+}
+
+// cacheReadBatchSize is the amount of nodes read from the cache at once.
+const cacheReadBatchSize = 10000
+
+// forEachCachedNode calls the callback for every node in the cache, in the
+// order of paths. The nodes are read by batches, so the callback may use
+// the cache (it has the only connection).
+func (ft *fileTree) forEachCachedNode(callback func(node) error) error {
+	lastPath := ""
+	for {
+		nodes, err := ft.queryCachedNodes("WHERE path > ? ORDER BY path LIMIT ?", lastPath, cacheReadBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return nil
+		}
+		for _, node := range nodes {
+			if err := callback(node); err != nil {
+				return err
+			}
+		}
+		lastPath = nodes[len(nodes)-1].path
+	}
+}
+
+// queryCachedNodes returns the nodes selected by the conditions (the part
+// of the query after "FROM file_tree").
+func (ft *fileTree) queryCachedNodes(conditions string, args ...interface{}) ([]node, error) {
+	query := "SELECT path, size, mtime, digest, sampled_digest, mode, dev, ino, nlink, rdev FROM file_tree " + conditions
+
+	ft.cacheDBTXLocker.Lock()
+	defer ft.cacheDBTXLocker.Unlock()
+	var rows *sql.Rows
+	var err error
+	if ft.cacheDBTX != nil {
+		// the only connection is taken by the transaction of the scan
+		rows, err = ft.cacheDBTX.Query(query, args...)
+	} else {
+		rows, err = ft.cacheDB.Query(query, args...)
+	}
 	if err != nil {
-		return errors.New(err)
+		return nil, errors.New(err)
 	}
 
 	defer rows.Close()
 
+	var result []node
 	for rows.Next() {
 		var node node
-		rows.Scan(&node.path, &node.size)
-
-		ft.nodeChan <- node
-		ft.nodeMapMutex.Lock()
-		ft.nodeMap[node.path] = node
-		ft.nodeMapMutex.Unlock()
+		var modTime, mode, dev, ino, nlink, rdev sql.NullInt64
+		if err := rows.Scan(&node.path, &node.size, &modTime, &node.digest, &node.sampledDigest, &mode, &dev, &ino, &nlink, &rdev); err != nil {
+			return nil, errors.New(err)
+		}
+		node.modTime = modTime.Int64
+		node.mode = os.FileMode(mode.Int64)
+		node.dev = uint64(dev.Int64)
+		node.ino = uint64(ino.Int64)
+		node.nlink = uint64(nlink.Int64)
+		node.rdev = uint64(rdev.Int64)
+		result = append(result, node)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return errors.New(err)
+		return nil, errors.New(err)
 	}
-	return nil
+	return result, nil
 }
 
 func (ft *fileTree) SplitList(hasher hash.Hash, levels uint, perm os.FileMode, skipChars uint) error {
@@ -273,34 +463,50 @@ func (ft *fileTree) SplitList(hasher hash.Hash, levels uint, perm os.FileMode, s
 	return nil
 }
 
-func (ft *fileTree) addNode(node node) {
-	ft.nodeMapMutex.Lock()
-	ft.nodeMap[node.path] = node
-	ft.nodeMapMutex.Unlock()
+// addNode adds the node to the index, and stores it to the cache (if
+// enabled). The returned error is about the cache only.
+func (ft *fileTree) addNode(node node) error {
+	ft.setNode(node)
 	ft.nodeChan <- node
 
 	ft.cacheDBTXLocker.Lock()
 	defer ft.cacheDBTXLocker.Unlock()
-	if ft.cacheDBTX != nil {
-		ft.cacheDBTX.Exec(`INSERT INTO file_tree (path, size) VALUES (?, ?)`, node.path, node.size)
+	if ft.cacheDBTX == nil {
+		return nil
+	}
+	_, err := ft.cacheDBTX.Exec(
+		`INSERT INTO file_tree (path, size, mtime, mode, dev, ino, nlink, rdev) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		node.path, node.size, node.modTime, uint32(node.mode), int64(node.dev), int64(node.ino), int64(node.nlink), int64(node.rdev),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to store '%s' to the cache: %w", node.path, err)
 	}
+	return nil
 }
 
-func (ft *fileTree) backgroundScan(maxDepth uint) {
+// backgroundScan scans the directories; maxDepth is relative to the root
+// directory. If there are no directories to scan (all of them are taken
+// from the cache), then the scan just finishes.
+func (ft *fileTree) backgroundScan(maxDepth uint, dirPaths []string) {
 	log.Println("Scanning root", ft.rootPath)
 
 	ctx, cancelFn := context.WithCancel(context.Background())
+	committedCh := make(chan struct{})
 	if ft.cacheDB != nil {
 		ft.commitCacheDBTX() // to create the first transaction
 
 		go func() {
+			defer close(committedCh)
 			ticker := time.NewTicker(time.Minute)
 			defer ticker.Stop()
 
 			// to commit the last transaction
 			defer func() {
 				ft.commitCacheDBTX()
+				ft.cacheDBTXLocker.Lock()
+				ft.cacheDBTX.Rollback() // the empty transaction started by the commit
 				ft.cacheDBTX = nil
+				ft.cacheDBTXLocker.Unlock()
 			}()
 
 			for {
@@ -314,11 +520,23 @@ func (ft *fileTree) backgroundScan(maxDepth uint) {
 		}()
 	}
 
-	ft.scanDirBackground(ft.rootPath, maxDepth)
+	for _, dirPath := range dirPaths {
+		depth := pathDepth(ft.relPath(dirPath))
+		switch {
+		case maxDepth == 0:
+			ft.scanDirBackground(dirPath, 0)
+		case depth < maxDepth:
+			ft.scanDirBackground(dirPath, maxDepth-depth)
+		}
+	}
 
 	go func() {
 		ft.scanWg.Wait()
 		cancelFn()
+		if ft.cacheDB != nil {
+			<-committedCh
+			ft.finishCacheScan()
+		}
 		close(ft.nodeChan)
 		log.Println("Scanning", ft.rootPath, "-- complete")
 	}()
@@ -347,20 +565,73 @@ func (ft *fileTree) commitCacheDBTX() {
 	}
 }
 
+// defaultSyncWorkers is the default amount of files copied concurrently.
+const defaultSyncWorkers = 16
+
+type SyncOptions struct {
+	DryRun  bool
+	Workers uint // the amount of files copied concurrently (zero means defaultSyncWorkers)
+	Compare Comparison
+	Salvage SalvageOptions
+	Mirror  MirrorOptions
+	Moves   MoveOptions
+
+	// Metadata defines which metadata to copy along with the contents.
+	Metadata MetadataOptions
+
+	// FileTypes defines how to sync symlinks, hardlinks and special files.
+	FileTypes FileTypeOptions
+
+	// FsyncDirs makes the directory of every written file to be fsync-ed
+	// after the file is renamed into place (the files themselves are
+	// always fsync-ed).
+	FsyncDirs bool
+
+	// ExcludeDigests are paths to hash trees (the text output of "hashtree"
+	// or its SQLite DB), the source files with contents present there are
+	// not copied.
+	ExcludeDigests []string
+}
+
+func (opts SyncOptions) workers() int {
+	if opts.Workers == 0 {
+		return defaultSyncWorkers
+	}
+	return int(opts.Workers)
+}
+
+// SyncResult is the summary of a sync.
+type SyncResult struct {
+	Copied  uint64 // files copied or recreated
+	Moved   uint64 // files renamed on the destination (see MoveOptions)
+	Linked  uint64 // files hardlinked on the destination
+	Skipped uint64 // files up to date, excluded or not copied for another reason
+	Failed  uint64
+	Bytes   uint64 // the total size of the copied files
+}
+
 func (ft *fileTree) SyncTo(
 	dstI FileTree,
 	excludeFTs []FileTree,
-	dryRun bool,
-) error {
-	return ft.syncTo(dstI.(*fileTree).rootPath, dstI, excludeFTs, dryRun)
+	opts SyncOptions,
+) (SyncResult, error) {
+	var result SyncResult
+	err := ft.syncTo(dstI.(*fileTree).rootPath, dstI, excludeFTs, opts, &result)
+	return result, err
 }
 
 func (ft *fileTree) syncTo(
 	dstRootDir string,
 	cmpI FileTree,
 	excludeFTIs []FileTree,
-	dryRun bool,
+	opts SyncOptions,
+	result *SyncResult,
 ) error {
+	// before waiting for the scans, which could take hours
+	if err := opts.FileTypes.Validate(); err != nil {
+		return err
+	}
+
 	log.Println("Syncing: wait for DST and EXC to complete scanning")
 	defer log.Println("Syncing -- complete")
 
@@ -369,10 +640,33 @@ func (ft *fileTree) syncTo(
 		excludeFTs = append(excludeFTs, ft.(*fileTree))
 	}
 
-	var filesToCopy []string
-
 	cmp := cmpI.(*fileTree)
 
+	// with a disk index the trees are compared by a sorted merge-join, and
+	// the files to copy are listed in a temporary file
+	useJoin := ft.diskIndex || cmp.diskIndex
+	if useJoin && opts.Moves.Enabled {
+		return fmt.Errorf("detecting moves is not supported with the disk index")
+	}
+
+	var filesToCopy []string
+	var filesToCopySpool *pathSpool
+	if useJoin {
+		var err error
+		filesToCopySpool, err = newPathSpool()
+		if err != nil {
+			return fmt.Errorf("unable to create the list of files to copy: %w", err)
+		}
+		defer filesToCopySpool.Close()
+	}
+	addFileToCopy := func(filePath string) error {
+		if filesToCopySpool != nil {
+			return filesToCopySpool.Add(filePath)
+		}
+		filesToCopy = append(filesToCopy, filePath)
+		return nil
+	}
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -393,180 +687,388 @@ func (ft *fileTree) syncTo(
 
 	wg.Wait()
 
+	cmp.removeTempFiles(opts.DryRun)
+
 	log.Println("Syncing: filtering")
 
-	for srcNode := range ft.nodeChan {
-		if ft.brokenFilesMap != nil {
-			ft.brokenFilesMapMutex.Lock()
-			isBrokenFile := ft.brokenFilesMap[srcNode.path]
-			ft.brokenFilesMapMutex.Unlock()
-			if isBrokenFile {
-				continue
-			}
-		}
+	compare := opts.Compare.comparator()
+	hardlinks := hardlinkGroups{}
 
-		dstNode := cmp.nodeMap[srcNode.path]
-		if srcNode.size == dstNode.size {
-			continue
+	var digestExcluder *digestExcluder
+	if len(opts.ExcludeDigests) > 0 {
+		var err error
+		digestExcluder, err = openDigestExcluder(opts.ExcludeDigests)
+		if err != nil {
+			return err
 		}
-		filesToCopy = append(filesToCopy, srcNode.path)
+		defer digestExcluder.Close()
 	}
 
-	sort.Strings(filesToCopy)
-
-	fmt.Println("Syncing: to copy report")
-	for _, filePath := range filesToCopy {
-		fmt.Println(filePath)
+	// every source file is counted once: as skipped here, or later as
+	// copied, moved, linked, failed or skipped
+	skip := func() error {
+		result.Skipped++
+		return nil
 	}
-	fmt.Println("Syncing: to copy report -- complete")
+	filterNode := func(srcNode node, dstNode node, dstOK bool) error {
+		if ft.brokenFiles.Has(srcNode.path) && !ft.salvageMap.HasMissing(srcNode.path) {
+			// partially salvaged files are re-attempted (see salvageFile)
+			return skip()
+		}
+		if ft.scanOptions.Filter.IsExcluded(srcNode.path, false) {
+			// the tree may be loaded from a cache made without the filter
+			return skip()
+		}
+		if isTempFile(srcNode.path) {
+			return skip()
+		}
 
-	log.Println("Syncing: copying")
+		if !srcNode.mode.IsRegular() {
+			if opts.FileTypes.policy(srcNode.mode) == FileTypePolicySkip {
+				log.Printf("Syncing: skipping '%s': the policy for files of type %v is to skip them", srcNode.path, srcNode.mode.Type())
+				return skip()
+			}
+			if !dstOK || !ft.isSpecialFileUpToDate(srcNode, cmp, dstNode) {
+				return addFileToCopy(srcNode.path)
+			}
+			return skip()
+		}
 
-	for _, filePath := range filesToCopy {
-		if dryRun {
-			continue
+		if dstOK && !dstNode.mode.IsRegular() {
+			dstOK = false
+		}
+		if dstOK && !ft.salvageMap.HasMissing(srcNode.path) && compare.IsEqual(ft, srcNode, cmp, dstNode) {
+			if opts.FileTypes.preserveHardlinks() && hardlinks.Add(srcNode, false) {
+				// counted by planHardlinks, the file could still need a link
+				return nil
+			}
+			return skip()
+		}
+		if digestExcluder != nil && digestExcluder.IsExcluded(ft, srcNode) {
+			log.Printf("Syncing: skipping '%s': its content is already in the excluded hash trees", srcNode.path)
+			return skip()
+		}
+		if opts.FileTypes.preserveHardlinks() {
+			hardlinks.Add(srcNode, true)
+		}
+		return addFileToCopy(srcNode.path)
+	}
+	if useJoin {
+		// the nodes are read from the indexes after the scan is complete
+		for range ft.nodeChan {
+		}
+		err := joinNodes(ft, cmp, func(srcNode, dstNode *node) error {
+			switch {
+			case srcNode == nil:
+				return nil
+			case dstNode == nil:
+				return filterNode(*srcNode, node{}, false)
+			}
+			return filterNode(*srcNode, *dstNode, true)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to compare the file trees: %w", err)
+		}
+	} else {
+		for srcNode := range ft.nodeChan {
+			dstNode, ok := cmp.nodeMap[srcNode.path]
+			filterNode(srcNode, dstNode, ok) // could fail only with the spool
 		}
+		sort.Strings(filesToCopy)
+	}
 
-		shouldExclude := false
-		for _, excFT := range excludeFTs {
-			_, ok := excFT.nodeMap[filePath]
-			if ok {
-				shouldExclude = true
-				break
+	var linked map[string]struct{}
+	var links []fileMove
+	if len(hardlinks) > 0 {
+		var upToDate uint64
+		linked, links, upToDate = ft.planHardlinks(cmp, hardlinks)
+		result.Skipped += upToDate
+	}
+
+	// forEachFileToCopy calls the callback for the files to copy, except
+	// the ones to be linked
+	forEachFileToCopy := func(callback func(filePath string) error) error {
+		fn := func(filePath string) error {
+			if _, ok := linked[filePath]; ok {
+				return nil
 			}
+			return callback(filePath)
 		}
-		if shouldExclude {
-			continue
+		if filesToCopySpool != nil {
+			return filesToCopySpool.ForEach(fn)
+		}
+		for _, filePath := range filesToCopy {
+			if err := fn(filePath); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		go func(filePath string) {
-			ft.semaphore.Acquire(context.TODO(), 2)
-			defer ft.semaphore.Release(2)
-			dstDir := filepath.Dir(path.Join(dstRootDir, filePath))
-			err := createDirectory(dstDir)
+	if opts.Moves.Enabled {
+		if opts.Mirror.Enabled {
+			// the files renamed away are deleted from their old paths, thus
+			// the limit is checked before anything is renamed (the old paths
+			// are still counted as files to delete here)
+			filesToDelete, err := ft.filesToDelete(dstRootDir, cmp, opts.Mirror)
 			if err != nil {
-				fmt.Println("cannot create directory", dstDir)
-				return
+				return err
 			}
-			err = copyFileContents(path.Join(ft.rootPath, filePath), path.Join(dstRootDir, filePath))
-			if err != nil {
-				// TODO: consider possible errors on the destination side
-				_, err = ft.addBrokenFile(filePath, err)
-				if err != nil {
-					panic(err)
-				}
+			if err := opts.Mirror.checkDeletions(len(filesToDelete)); err != nil {
+				return err
 			}
-		}(filePath)
+		}
+
+		// it is not the spool (see useJoin), thus it does not fail
+		var rest []string
+		forEachFileToCopy(func(filePath string) error {
+			rest = append(rest, filePath)
+			return nil
+		})
+		var err error
+		filesToCopy, err = ft.detectMoves(dstRootDir, cmp, rest, opts, result)
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
-}
+	fmt.Println("Syncing: to copy report")
+	err := forEachFileToCopy(func(filePath string) error {
+		fmt.Println(filePath)
+		return nil
+	})
+	fmt.Println("Syncing: to copy report -- complete")
+	if err != nil {
+		return fmt.Errorf("unable to read the list of files to copy: %w", err)
+	}
 
-func (ft *fileTree) SetBrokenFilesList(path string) error {
-	var err error
+	if len(links) > 0 {
+		fmt.Println("Syncing: to link report")
+		for _, link := range links {
+			fmt.Println(link.from, "->", link.to)
+		}
+		fmt.Println("Syncing: to link report -- complete")
+	}
 
-	if ft.brokenFilesList != nil {
-		ft.brokenFilesList.Close()
+	if opts.Mirror.Enabled {
+		if err := ft.mirrorDeletions(dstRootDir, cmp, opts); err != nil {
+			return err
+		}
 	}
 
-	ft.brokenFilesListPath = path
+	log.Println("Syncing: copying")
 
-	if _, err := os.Stat(ft.brokenFilesListPath); os.IsNotExist(err) {
-		ft.brokenFilesList, err = os.Create(ft.brokenFilesListPath)
-		return errors.Wrap(err, ft.brokenFilesListPath)
+	isExcludedByTrees := func(filePath string) bool {
+		for _, excFT := range excludeFTs {
+			if _, ok := excFT.getNode(filePath); ok {
+				return true
+			}
+		}
+		return false
 	}
 
-	ft.brokenFilesList, err = os.OpenFile(ft.brokenFilesListPath, os.O_APPEND|os.O_RDWR, os.ModeAppend)
-	if err != nil {
-		return errors.New(err, ft.brokenFilesListPath)
+	var stopped atomic.Bool
+	var errs *multierror.Error
+	var errsLocker sync.Mutex
+	addError := func(filePath string, err error) {
+		atomic.AddUint64(&result.Failed, 1)
+		if err == nil {
+			return
+		}
+		errsLocker.Lock()
+		defer errsLocker.Unlock()
+		errs = multierror.Append(errs, fmt.Errorf("'%s': %w", filePath, err))
 	}
 
-	scanner := bufio.NewScanner(ft.brokenFilesList)
-	ft.brokenFilesMapMutex.Lock()
-	for scanner.Scan() {
-		ft.brokenFilesMap[scanner.Text()] = true
-	}
-	defer ft.brokenFilesMapMutex.Unlock()
+	dirMetadata := newDirMetadataQueue()
+	copyFile := func(filePath string) {
+		ft.semaphore.Acquire(context.TODO(), 2)
+		defer ft.semaphore.Release(2)
+		if stopped.Load() {
+			// the reason is already reported
+			addError(filePath, nil)
+			return
+		}
+		srcPath, dstPath := path.Join(ft.rootPath, filePath), path.Join(dstRootDir, filePath)
+		srcNode, _ := ft.getNode(filePath)
+
+		// before reading the file, to get the original atime
+		commit, err := newCommitOptions(srcPath, opts.Metadata, opts.FsyncDirs)
+
+		dstDir := filepath.Dir(dstPath)
+		if err != nil {
+			err = withPhase(BrokenFilePhaseLstat, err)
+		} else if err = createDirectory(dstDir); err != nil {
+			err = withPhase(BrokenFilePhaseWrite, fmt.Errorf("cannot create directory '%s': %w", dstDir, err))
+		} else if err = clearDestination(dstPath, srcNode.mode); err != nil {
+			err = withPhase(BrokenFilePhaseWrite, fmt.Errorf("cannot replace '%s': %w", dstPath, err))
+		} else {
+			switch {
+			case !srcNode.mode.IsRegular():
+				err = recreateSpecialFile(srcPath, dstPath, srcNode)
+				if err == nil && commit.prepare != nil {
+					// special files are not written via a temporary file
+					err = withPhase(BrokenFilePhaseWrite, commit.prepare(dstPath))
+				}
+			case opts.Salvage.Enabled:
+				err = ft.salvageFile(filePath, srcPath, dstPath, opts.Salvage, commit)
+			default:
+				err = ft.copyFileContents(srcPath, dstPath, commit)
+			}
+		}
+		if err == nil {
+			atomic.AddUint64(&result.Copied, 1)
+			if srcNode.mode.IsRegular() {
+				atomic.AddUint64(&result.Bytes, uint64(srcNode.size))
+			}
+			if opts.Metadata.Enabled() {
+				dirMetadata.AddParents(filePath)
+			}
+			return
+		}
+		addError(filePath, err)
+
+		if errorPhase(err) != BrokenFilePhaseWrite {
+			_, err = ft.addBrokenFile(filePath, err)
+			if err != nil {
+				panic(err)
+			}
+			return
+		}
 
-	if err := scanner.Err(); err != nil {
-		return errors.New(err)
+		// the source file is fine, it is the destination who failed;
+		// so it is reported to the destination's list, and is going to be retried next time
+		if isFatalDestinationError(err) && stopped.CompareAndSwap(false, true) {
+			log.Println("Syncing: stopping due to a destination error:", err)
+		}
+		if _, err := cmp.addBrokenFile(filePath, err); err != nil {
+			panic(err)
+		}
 	}
 
-	return nil
-}
+	fileCh := make(chan string)
+	var workersWg sync.WaitGroup
+	for i := 0; i < opts.workers(); i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for filePath := range fileCh {
+				copyFile(filePath)
+			}
+		}()
+	}
+	err = forEachFileToCopy(func(filePath string) error {
+		if opts.DryRun || isExcludedByTrees(filePath) {
+			result.Skipped++
+			return nil
+		}
+		fileCh <- filePath
+		return nil
+	})
+	close(fileCh)
+	workersWg.Wait()
+	if err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("unable to read the list of files to copy: %w", err))
+	}
 
-func (ft *fileTree) addBrokenFile(filePath string, fileErr error) (bool, error) {
-	ft.brokenFilesMapMutex.Lock()
-	defer ft.brokenFilesMapMutex.Unlock()
-	if ft.brokenFilesMap[filePath] {
-		return false, nil
+	if opts.DryRun {
+		result.Skipped += uint64(len(links))
+	} else {
+		// the files to link to should be copied first, thus it is after the copying
+		for _, link := range links {
+			if isExcludedByTrees(link.to) {
+				result.Skipped++
+				continue
+			}
+			if stopped.Load() {
+				addError(link.to, nil)
+				continue
+			}
+			if err := linkFile(dstRootDir, link); err != nil {
+				log.Printf("Syncing: unable to link '%s' to '%s', going to copy it instead: %v", link.to, link.from, err)
+				copyFile(link.to)
+				continue
+			}
+			atomic.AddUint64(&result.Linked, 1)
+			fmt.Println("linked file:", link.from, "->", link.to)
+			if opts.Metadata.Enabled() {
+				dirMetadata.AddParents(link.to)
+			}
+		}
 	}
-	ft.brokenFilesMap[filePath] = true
-	fmt.Println("broken file:", filePath, fileErr)
-	if ft.brokenFilesList == nil {
-		return true, nil
+
+	if opts.Metadata.Enabled() {
+		// directory metadata could be applied only after their contents are written
+		if err := dirMetadata.Apply(ft.rootPath, dstRootDir, opts.Metadata); err != nil {
+			log.Printf("Syncing: unable to preserve metadata of directories: %v", err)
+		}
 	}
-	_, err := ft.brokenFilesList.Write([]byte(fmt.Sprintf("%s\n", filePath)))
-	return true, errors.Wrap(err)
+
+	return errs.ErrorOrNil()
 }
 
 func createDirectory(dir string) error {
 	return os.MkdirAll(dir, os.ModePerm)
 }
 
-func copyFileContents(ft, dst string) (err error) {
-	in, err := os.Open(ft)
+// copyFileContents copies the file atomically (see atomicFile).
+func (ft *fileTree) copyFileContents(src, dst string, commit commitOptions) (err error) {
+	in, err := ft.openSourceFile(src)
 	if err != nil {
-		return errors.New(err)
+		return withPhase(BrokenFilePhaseOpen, errors.New(err))
 	}
 
 	defer in.Close()
-	out, err := os.Create(dst)
+	out, err := createAtomicFile(dst)
 	if err != nil {
-		return errors.New(err)
+		return withPhase(BrokenFilePhaseWrite, errors.New(err))
 	}
 
 	defer func() {
-		closeErr := out.Close()
-		if err == nil {
-			err = closeErr
+		if err != nil {
+			out.Abort()
+			return
+		}
+		if commitErr := out.Commit(commit); commitErr != nil {
+			err = withPhase(BrokenFilePhaseWrite, errors.New(commitErr))
 		}
 	}()
 
-	buf := make([]byte, 1024*1024)
+	inReader := newSequentialReader(in)
+
+	// reading to one buffer, while writing from the other one
+	bufs := [2][]byte{
+		make([]byte, copyBufferSize),
+		make([]byte, copyBufferSize),
+	}
 
 	writeResultChan := make(chan error, 1)
 	writeResultChan <- nil
 
-	for {
-		rn, err := io.ReadFull(in, buf)
+	for i := 0; ; i++ {
+		buf := bufs[i%2]
+		rn, rErr := io.ReadFull(inReader, buf)
 		wErr := <-writeResultChan
 		if wErr != nil {
-			return errors.Wrap(wErr)
-		}
-		if err == io.EOF {
-			break
+			return withPhase(BrokenFilePhaseWrite, errors.Wrap(wErr))
 		}
-		if err != nil {
-			return errors.Wrap(err)
+		switch rErr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			if _, err := out.Write(buf[:rn]); err != nil {
+				return withPhase(BrokenFilePhaseWrite, errors.Wrap(err))
+			}
+			return nil
+		default:
+			return withPhase(BrokenFilePhaseRead, errors.Wrap(rErr))
 		}
 
-		go func(rn int) {
+		go func(buf []byte) {
 			wn, err := out.Write(buf)
-			if wn != rn {
-				writeResultChan <- fmt.Errorf("written != read: %d != %d", wn, rn)
-				return
+			if err == nil && wn != len(buf) {
+				err = fmt.Errorf("written != read: %d != %d", wn, len(buf))
 			}
-			if err != nil {
-				writeResultChan <- err
-				return
-			}
-			writeResultChan <- nil
-		}(rn)
+			writeResultChan <- err
+		}(buf[:rn])
 	}
-
-	/*if _, err = io.Copy(out, in); err != nil {
-		return errors.New(err)
-	}*/
-	return
 }
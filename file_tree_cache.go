@@ -0,0 +1,343 @@
+package slowsync
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xaionaro-go/errors"
+)
+
+// cacheScanState is the state of the scan, which filled the cache.
+type cacheScanState struct {
+	rootPath     string
+	scanStarted  time.Time
+	scanFinished time.Time
+	complete     bool
+}
+
+// startCacheScan stores the state of a new scan. The state is stored in two
+// tables: file_tree_meta has a single row about the scan, and file_tree_dirs
+// has the directories found so far, "listed" is set when all the entries of
+// the directory are stored.
+func (ft *fileTree) startCacheScan() error {
+	_, err := ft.cacheDB.Exec(
+		`INSERT INTO file_tree_meta (root_path, scan_started, complete) VALUES (?, ?, 0)`,
+		ft.rootPath, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// readCacheScanState returns nil if the state is not stored (the cache
+// was made by an older version).
+func (ft *fileTree) readCacheScanState() (*cacheScanState, error) {
+	var state cacheScanState
+	var scanStarted, scanFinished, complete sql.NullInt64
+	err := ft.cacheDB.QueryRow(`SELECT root_path, scan_started, scan_finished, complete FROM file_tree_meta`).
+		Scan(&state.rootPath, &scanStarted, &scanFinished, &complete)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.New(err)
+	}
+	state.scanStarted = time.Unix(0, scanStarted.Int64)
+	if scanFinished.Valid {
+		state.scanFinished = time.Unix(0, scanFinished.Int64)
+	}
+	state.complete = complete.Int64 != 0
+	return &state, nil
+}
+
+// restartCacheScan marks the scan as started again.
+func (ft *fileTree) restartCacheScan(tx *sql.Tx) error {
+	if _, err := tx.Exec(`DELETE FROM file_tree_meta`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		`INSERT INTO file_tree_meta (root_path, scan_started, complete) VALUES (?, ?, 0)`,
+		ft.rootPath, time.Now().UnixNano(),
+	)
+	return err
+}
+
+func (ft *fileTree) finishCacheScan() {
+	_, err := ft.cacheDB.Exec(`UPDATE file_tree_meta SET scan_finished = ?, complete = 1`, time.Now().UnixNano())
+	if err != nil {
+		log.Printf("unable to mark the scan as complete in the cache: %v", err)
+	}
+}
+
+// cacheDirFound stores the directory to the cache as not listed yet (if it is not stored already).
+func (ft *fileTree) cacheDirFound(dirPath string) error {
+	ft.cacheDBTXLocker.Lock()
+	defer ft.cacheDBTXLocker.Unlock()
+	if ft.cacheDBTX == nil {
+		return nil
+	}
+	_, err := ft.cacheDBTX.Exec(`INSERT OR IGNORE INTO file_tree_dirs (path, listed) VALUES (?, 0)`, ft.relPath(dirPath))
+	if err != nil {
+		return fmt.Errorf("unable to store the directory '%s' to the cache: %w", dirPath, err)
+	}
+	return nil
+}
+
+// cacheDirListed marks the directory as listed in the cache, and stores its
+// times (dirInfo should be taken before the listing) and if the listing was
+// complete (see markDirIncomplete). It is in the same transaction as (or in
+// a later one than) the entries of the directory, thus a listed directory
+// always has all its entries stored.
+func (ft *fileTree) cacheDirListed(dirPath string, dirInfo os.FileInfo, complete bool) error {
+	mtime, ctime := dirTimes(dirInfo)
+	ft.cacheDBTXLocker.Lock()
+	defer ft.cacheDBTXLocker.Unlock()
+	if ft.cacheDBTX == nil {
+		return nil
+	}
+	_, err := ft.cacheDBTX.Exec(
+		`INSERT OR REPLACE INTO file_tree_dirs (path, listed, mtime, ctime, complete) VALUES (?, 1, ?, ?, ?)`,
+		ft.relPath(dirPath), mtime, ctime, complete,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to mark the directory '%s' as listed in the cache: %w", dirPath, err)
+	}
+	return nil
+}
+
+func dirTimes(dirInfo os.FileInfo) (mtime, ctime int64) {
+	mtime = dirInfo.ModTime().UnixNano()
+	if stat, ok := dirInfo.Sys().(*syscall.Stat_t); ok {
+		ctime = stat.Ctim.Nano()
+	}
+	return
+}
+
+// isDirCachedListed returns true if the entries of the directory are
+// taken from the cache (see rescan).
+func (ft *fileTree) isDirCachedListed(dirPath string) bool {
+	_, ok := ft.cachedListedDirs[ft.relPath(dirPath)]
+	return ok
+}
+
+type cachedDir struct {
+	path     string
+	listed   bool
+	mtime    int64
+	ctime    int64 // zero if unknown
+	complete bool  // false if unknown
+}
+
+func (ft *fileTree) readCachedDirs() ([]cachedDir, error) {
+	rows, err := ft.cacheDB.Query(`SELECT path, listed, mtime, ctime, complete FROM file_tree_dirs`)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	defer rows.Close()
+
+	var result []cachedDir
+	for rows.Next() {
+		var dir cachedDir
+		var mtime, ctime, complete sql.NullInt64
+		if err := rows.Scan(&dir.path, &dir.listed, &mtime, &ctime, &complete); err != nil {
+			return nil, errors.New(err)
+		}
+		dir.mtime, dir.ctime = mtime.Int64, ctime.Int64
+		dir.complete = complete.Int64 != 0
+		result = append(result, dir)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err)
+	}
+	return result, nil
+}
+
+// resumeScan continues the interrupted scan: the entries of listed
+// directories are read from the cache, and the rest are scanned again.
+func (ft *fileTree) resumeScan(maxDepth uint) error {
+	dirs, err := ft.readCachedDirs()
+	if err != nil {
+		return err
+	}
+	listed := map[string]struct{}{}
+	for _, dir := range dirs {
+		if dir.listed {
+			listed[dir.path] = struct{}{}
+		}
+	}
+	log.Printf("Resuming the scan of %s: %d directories are listed", ft.rootPath, len(listed))
+	return ft.rescan(maxDepth, dirs, listed)
+}
+
+// refreshScan updates a complete cache: the directories changed since
+// they were listed (by mtime and ctime) are listed again, and the entries
+// of the rest are read from the cache. Files modified in place do not
+// change the times of their directories, thus they are not noticed.
+func (ft *fileTree) refreshScan(maxDepth uint) error {
+	dirs, err := ft.readCachedDirs()
+	if err != nil {
+		return err
+	}
+
+	unchanged := map[string]struct{}{}
+	var existing []cachedDir
+	var changed, removed []string
+	for _, dir := range dirs {
+		dirInfo, err := os.Lstat(filepath.Join(ft.rootPath, dir.path))
+		switch {
+		case os.IsNotExist(err):
+			removed = append(removed, dir.path)
+			continue
+		case err != nil:
+			// let the scan to report the error
+			dir.listed = false
+		default:
+			mtime, ctime := dirTimes(dirInfo)
+			if dir.ctime == 0 || mtime != dir.mtime || ctime != dir.ctime {
+				dir.listed = false
+			}
+		}
+		if dir.listed {
+			unchanged[dir.path] = struct{}{}
+		} else {
+			changed = append(changed, dir.path)
+		}
+		existing = append(existing, dir)
+	}
+	log.Printf("Refreshing the scan of %s: %d directories are unchanged, %d are changed, %d are removed",
+		ft.rootPath, len(unchanged), len(changed), len(removed))
+
+	// it is a single transaction, so an interrupted refresh is resumed as a usual scan
+	tx, err := ft.cacheDB.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+	err = ft.restartCacheScan(tx)
+	for _, dirPath := range changed {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(`UPDATE file_tree_dirs SET listed = 0 WHERE path = ?`, dirPath)
+	}
+	for _, dirPath := range removed {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(`DELETE FROM file_tree_dirs WHERE path = ?`, dirPath)
+	}
+	if err != nil {
+		tx.Rollback()
+		return errors.New(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(err)
+	}
+
+	return ft.rescan(maxDepth, existing, unchanged)
+}
+
+// rescan takes the entries of the valid directories from the cache, and
+// scans the rest of the directories again.
+func (ft *fileTree) rescan(maxDepth uint, dirs []cachedDir, valid map[string]struct{}) error {
+	ft.cachedListedDirs = valid
+	for _, dir := range dirs {
+		if _, ok := valid[dir.path]; !ok {
+			continue
+		}
+		// the listing is still valid, and so is its completeness
+		dirPath := filepath.Join(ft.rootPath, dir.path)
+		if dir.complete {
+			ft.markDirListed(dirPath)
+		} else {
+			ft.markDirIncomplete(dirPath)
+		}
+	}
+	isValid := func(n node) bool {
+		_, ok := valid[filepath.Dir(n.path)]
+		return ok
+	}
+
+	// the entries of other directories could be incomplete or outdated,
+	// they are going to be added again by the scan
+	var invalidPaths []string
+	err := ft.forEachCachedNode(func(n node) error {
+		if isValid(n) {
+			ft.setNode(n)
+		} else {
+			invalidPaths = append(invalidPaths, n.path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tx, err := ft.cacheDB.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+	for _, filePath := range invalidPaths {
+		if _, err := tx.Exec(`DELETE FROM file_tree WHERE path = ?`, filePath); err != nil {
+			tx.Rollback()
+			return errors.New(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(err)
+	}
+
+	ft.scanWg.Add(1)
+	go func() {
+		defer ft.scanWg.Done()
+		// the scan adds the nodes of the invalid directories meanwhile,
+		// they are sent by addNode
+		err := ft.forEachCachedNode(func(n node) error {
+			if isValid(n) {
+				ft.nodeChan <- n
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("unable to read the cache: %v", err)
+		}
+	}()
+
+	// an invalid directory is reached by scanning its parent, unless
+	// the parent is valid
+	var dirPaths []string
+	if _, ok := valid["."]; !ok {
+		dirPaths = append(dirPaths, ft.rootPath)
+	}
+	for _, dir := range dirs {
+		if _, ok := valid[dir.path]; ok || dir.path == "." {
+			continue
+		}
+		if _, ok := valid[filepath.Dir(dir.path)]; ok {
+			dirPaths = append(dirPaths, filepath.Join(ft.rootPath, dir.path))
+		}
+	}
+	log.Printf("Scanning %d directories of %s", len(dirPaths), ft.rootPath)
+	ft.backgroundScan(maxDepth, dirPaths)
+	return nil
+}
+
+// checkRoot returns an error if the cache was made for another directory.
+func (state *cacheScanState) checkRoot(rootPath string) error {
+	if state.rootPath != rootPath {
+		return fmt.Errorf("the cache was made for '%s', not for '%s'", state.rootPath, rootPath)
+	}
+	return nil
+}
+
+func pathDepth(relPath string) uint {
+	if relPath == "." {
+		return 0
+	}
+	return uint(strings.Count(relPath, "/")) + 1
+}
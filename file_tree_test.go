@@ -0,0 +1,97 @@
+package slowsync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSyncToResult(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		src       map[string]string
+		srcLinks  map[string]string // hardlinks to the source files: link -> file
+		dst       map[string]string
+		dstOnDisk map[string]string // not in the index of the destination
+		opts      SyncOptions
+
+		expectedResult SyncResult
+		expectedErr    bool
+		expectedFiles  []string
+	}{
+		{
+			name:           "copied and up to date",
+			src:            map[string]string{"a": "same", "b": "new", "c": "new", "d/e": "new"},
+			dst:            map[string]string{"a": "same", "b": "old content"},
+			opts:           SyncOptions{Workers: 2},
+			expectedResult: SyncResult{Copied: 3, Skipped: 1, Bytes: 9},
+			expectedFiles:  []string{"a", "b", "c", "d/", "d/e"},
+		},
+		{
+			name:           "dry run",
+			src:            map[string]string{"a": "same", "b": "new"},
+			dst:            map[string]string{"a": "same"},
+			opts:           SyncOptions{DryRun: true},
+			expectedResult: SyncResult{Skipped: 2},
+			expectedFiles:  []string{"a"},
+		},
+		{
+			name:           "failed",
+			src:            map[string]string{"a": "new", "x/b": "new"},
+			dstOnDisk:      map[string]string{"x": "not a directory"},
+			expectedResult: SyncResult{Copied: 1, Failed: 1, Bytes: 3},
+			expectedErr:    true,
+			expectedFiles:  []string{"a", "x"},
+		},
+		{
+			name:           "hardlinks",
+			src:            map[string]string{"a": "new", "c": "other"},
+			srcLinks:       map[string]string{"b": "a"},
+			dst:            map[string]string{"c": "other"},
+			expectedResult: SyncResult{Copied: 1, Linked: 1, Skipped: 1, Bytes: 3},
+			expectedFiles:  []string{"a", "b", "c"},
+		},
+		{
+			name:           "up to date hardlinks",
+			src:            map[string]string{"a": "same"},
+			srcLinks:       map[string]string{"b": "a"},
+			dst:            map[string]string{"a": "same", "b": "same"},
+			expectedResult: SyncResult{Linked: 1, Skipped: 1},
+			expectedFiles:  []string{"a", "b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := newDiskTestFileTree(t, tc.src)
+			dst := newDiskTestFileTree(t, tc.dst)
+			for link, filePath := range tc.srcLinks {
+				if err := os.Link(filepath.Join(src.rootPath, filePath), filepath.Join(src.rootPath, link)); err != nil {
+					t.Fatal(err)
+				}
+				// nlink is changed for both of the files
+				for _, linkedPath := range []string{link, filePath} {
+					fileInfo, err := os.Lstat(filepath.Join(src.rootPath, linkedPath))
+					if err != nil {
+						t.Fatal(err)
+					}
+					src.setNode(newNode(linkedPath, fileInfo))
+				}
+			}
+			for filePath, content := range tc.dstOnDisk {
+				writeTestFile(t, dst.rootPath, filePath, content)
+			}
+			prepareTestSync(src, dst)
+
+			result, err := src.SyncTo(dst, nil, tc.opts)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("got error %v, expected an error: %v", err, tc.expectedErr)
+			}
+			if result != tc.expectedResult {
+				t.Errorf("got result %+v, expected %+v", result, tc.expectedResult)
+			}
+			if files := listTestDir(t, dst.rootPath); !reflect.DeepEqual(files, tc.expectedFiles) {
+				t.Errorf("got files %q, expected %q", files, tc.expectedFiles)
+			}
+		})
+	}
+}
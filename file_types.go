@@ -0,0 +1,276 @@
+package slowsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// FileTypePolicy defines what to do with files, which are not regular ones
+// (or are hardlinked).
+type FileTypePolicy string
+
+const (
+	// FileTypePolicyDefault is the default policy of the type (see FileTypeOptions).
+	FileTypePolicyDefault = FileTypePolicy("")
+
+	// FileTypePolicyRecreate recreates the file on the destination: symlinks
+	// as symlinks, hardlinks as hardlinks, and device nodes, FIFOs and
+	// sockets by mknod() (device nodes require root).
+	FileTypePolicyRecreate = FileTypePolicy("recreate")
+
+	// FileTypePolicySkip does not sync the files.
+	FileTypePolicySkip = FileTypePolicy("skip")
+
+	// FileTypePolicyCopy copies hardlinked files as independent files.
+	FileTypePolicyCopy = FileTypePolicy("copy")
+)
+
+// ParseFileTypePolicy parses the name of a policy: recreate, skip or copy.
+func ParseFileTypePolicy(s string) (FileTypePolicy, error) {
+	switch p := FileTypePolicy(s); p {
+	case FileTypePolicyRecreate, FileTypePolicySkip, FileTypePolicyCopy:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown file type policy '%s'", s)
+}
+
+// FileTypeOptions defines the policies of syncing files of different types.
+type FileTypeOptions struct {
+	// Symlinks are recreated by default, or skipped.
+	Symlinks FileTypePolicy
+
+	// Hardlinks (regular files with the same inode) are recreated by
+	// default, or copied as independent files.
+	Hardlinks FileTypePolicy
+
+	// Devices, FIFOs and Sockets are skipped by default, or recreated.
+	Devices FileTypePolicy
+	FIFOs   FileTypePolicy
+	Sockets FileTypePolicy
+}
+
+// Validate returns an error if a policy is not supported for its file type.
+func (opts FileTypeOptions) Validate() error {
+	for _, check := range []struct {
+		name    string
+		policy  FileTypePolicy
+		allowed []FileTypePolicy
+	}{
+		{"symlinks", opts.Symlinks, []FileTypePolicy{FileTypePolicyRecreate, FileTypePolicySkip}},
+		{"hardlinks", opts.Hardlinks, []FileTypePolicy{FileTypePolicyRecreate, FileTypePolicyCopy}},
+		{"devices", opts.Devices, []FileTypePolicy{FileTypePolicyRecreate, FileTypePolicySkip}},
+		{"FIFOs", opts.FIFOs, []FileTypePolicy{FileTypePolicyRecreate, FileTypePolicySkip}},
+		{"sockets", opts.Sockets, []FileTypePolicy{FileTypePolicyRecreate, FileTypePolicySkip}},
+	} {
+		if check.policy == FileTypePolicyDefault {
+			continue
+		}
+		isAllowed := false
+		for _, allowed := range check.allowed {
+			if check.policy == allowed {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed {
+			return fmt.Errorf("policy '%s' is not supported for %s, supported: %v", check.policy, check.name, check.allowed)
+		}
+	}
+	return nil
+}
+
+// policy returns the policy for the file of the mode (zero for regular files).
+func (opts FileTypeOptions) policy(mode os.FileMode) FileTypePolicy {
+	var p, defaultPolicy FileTypePolicy
+	switch {
+	case mode&os.ModeSymlink != 0:
+		p, defaultPolicy = opts.Symlinks, FileTypePolicyRecreate
+	case mode&os.ModeDevice != 0:
+		p, defaultPolicy = opts.Devices, FileTypePolicySkip
+	case mode&os.ModeNamedPipe != 0:
+		p, defaultPolicy = opts.FIFOs, FileTypePolicySkip
+	case mode&os.ModeSocket != 0:
+		p, defaultPolicy = opts.Sockets, FileTypePolicySkip
+	case mode.IsRegular():
+		return FileTypePolicyCopy
+	default:
+		// unknown types (like Solaris doors) are never synced
+		return FileTypePolicySkip
+	}
+	if p == FileTypePolicyDefault {
+		return defaultPolicy
+	}
+	return p
+}
+
+func (opts FileTypeOptions) preserveHardlinks() bool {
+	return opts.Hardlinks != FileTypePolicyCopy
+}
+
+// isSpecialFileUpToDate compares files which are not regular ones.
+func (ft *fileTree) isSpecialFileUpToDate(srcNode node, cmp *fileTree, dstNode node) bool {
+	if srcNode.mode.Type() != dstNode.mode.Type() {
+		return false
+	}
+	switch {
+	case srcNode.mode&os.ModeSymlink != 0:
+		srcTarget, err := os.Readlink(filepath.Join(ft.rootPath, srcNode.path))
+		if err != nil {
+			return false
+		}
+		dstTarget, err := os.Readlink(filepath.Join(cmp.rootPath, dstNode.path))
+		if err != nil {
+			return false
+		}
+		return srcTarget == dstTarget
+	case srcNode.mode&os.ModeDevice != 0:
+		return srcNode.rdev == dstNode.rdev
+	}
+	return true
+}
+
+// clearDestination removes the destination file, unless both it and the
+// source are regular files (to not write through a symlink, for example).
+func clearDestination(dstPath string, srcMode os.FileMode) error {
+	fileInfo, err := os.Lstat(dstPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if srcMode.IsRegular() && fileInfo.Mode().IsRegular() {
+		return nil
+	}
+	if fileInfo.IsDir() {
+		return fmt.Errorf("'%s' is a directory", dstPath)
+	}
+	return os.Remove(dstPath)
+}
+
+// recreateSpecialFile recreates a symlink, a device node, a FIFO or a socket.
+func recreateSpecialFile(src, dst string, srcNode node) error {
+	if srcNode.mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return withPhase(BrokenFilePhaseRead, err)
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return withPhase(BrokenFilePhaseWrite, err)
+		}
+		return nil
+	}
+
+	var fileType uint32
+	switch {
+	case srcNode.mode&os.ModeCharDevice != 0:
+		fileType = syscall.S_IFCHR
+	case srcNode.mode&os.ModeDevice != 0:
+		fileType = syscall.S_IFBLK
+	case srcNode.mode&os.ModeNamedPipe != 0:
+		fileType = syscall.S_IFIFO
+	case srcNode.mode&os.ModeSocket != 0:
+		fileType = syscall.S_IFSOCK
+	default:
+		return fmt.Errorf("unsupported file type: %v", srcNode.mode.Type())
+	}
+	if err := syscall.Mknod(dst, fileType|uint32(srcNode.mode.Perm()), int(srcNode.rdev)); err != nil {
+		return withPhase(BrokenFilePhaseWrite, &os.PathError{Op: "mknod", Path: dst, Err: err})
+	}
+	return nil
+}
+
+// hardlinkGroups are the source files sharing inodes.
+type hardlinkGroups map[inodeID][]hardlinkedFile
+
+type hardlinkedFile struct {
+	path   string
+	toCopy bool // the file is not up to date on the destination
+}
+
+// Add adds the file to its group, if the file is hardlinked. It returns
+// false if it is not.
+func (g hardlinkGroups) Add(n node, toCopy bool) bool {
+	if n.nlink < 2 || !n.mode.IsRegular() || n.ino == 0 {
+		return false
+	}
+	id := inodeID{dev: n.dev, ino: n.ino}
+	g[id] = append(g[id], hardlinkedFile{path: n.path, toCopy: toCopy})
+	return true
+}
+
+// planHardlinks returns the files, which should not be copied, since they are
+// linked to the first file of their hardlink group instead (all the files
+// except the first one of each group), the links to make (after the
+// first files are copied), and the amount of the files which need neither
+// to be copied nor to be linked.
+func (ft *fileTree) planHardlinks(cmp *fileTree, groups hardlinkGroups) (map[string]struct{}, []fileMove, uint64) {
+	linked := map[string]struct{}{}
+	var links []fileMove
+	var upToDate uint64
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].path < group[j].path
+		})
+		if !group[0].toCopy {
+			upToDate++
+		}
+		if len(group) < 2 {
+			continue
+		}
+		first := group[0].path
+		firstDstNode, firstOnDst := cmp.getNode(first)
+		for _, file := range group[1:] {
+			linked[file.path] = struct{}{}
+			dstNode, ok := cmp.getNode(file.path)
+			if !group[0].toCopy && firstOnDst && ok && dstNode.ino != 0 &&
+				dstNode.dev == firstDstNode.dev && dstNode.ino == firstDstNode.ino {
+				// already linked
+				upToDate++
+				continue
+			}
+			links = append(links, fileMove{from: first, to: file.path})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].to < links[j].to
+	})
+	return linked, links, upToDate
+}
+
+// linkFile hardlinks link.to to link.from on the destination, replacing
+// the existing file. The link is made under a temporary name and renamed
+// into place (like atomicFile), thus the existing file is kept if the link
+// could not be made.
+func linkFile(dstRootDir string, link fileMove) error {
+	from := filepath.Join(dstRootDir, link.from)
+	to := filepath.Join(dstRootDir, link.to)
+	dir, base := filepath.Split(to)
+	if err := createDirectory(dir); err != nil {
+		return err
+	}
+	cleanTempFilesInDir(dir)
+	for {
+		tempPath := filepath.Join(dir, tempFileName(base))
+		err := os.Link(from, tempPath)
+		if os.IsExist(err) {
+			// left by a killed process with the same PID
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tempPath, to); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		// the rename does nothing if link.to is already a link to the same file
+		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,186 @@
+package slowsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Filter decides which files are scanned and synced, similar to rsync
+// filter rules. Rules are checked in the order they were added, the first
+// matching one wins; a path not matched by any rule is included.
+//
+// A pattern is matched against the path relative to the root (as it is
+// stored in the cache):
+//   - a pattern starting with "/" or containing "/" elsewhere (except
+//     a trailing one) is anchored to the root, otherwise it may match
+//     the end of the path at any directory boundary;
+//   - a pattern ending with "/" matches only directories;
+//   - "*" matches anything except "/", "**" matches anything, "?" matches
+//     a single character except "/", "[...]" matches a character class;
+//   - a pattern starting with "re:" is a regular expression, which is
+//     matched against the whole relative path.
+//
+// If a directory is excluded, then everything inside it is excluded as well.
+type Filter struct {
+	rules []filterRule
+}
+
+type filterRule struct {
+	include bool
+	dirOnly bool
+	re      *regexp.Regexp
+	pattern string
+}
+
+// NewFilter returns an empty filter (which includes everything).
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Include adds a rule including the paths matching the pattern.
+func (f *Filter) Include(pattern string) error {
+	return f.addRule(true, pattern)
+}
+
+// Exclude adds a rule excluding the paths matching the pattern.
+func (f *Filter) Exclude(pattern string) error {
+	return f.addRule(false, pattern)
+}
+
+// AddRule adds a rule in the rsync-like form: "+ <pattern>" or "- <pattern>".
+func (f *Filter) AddRule(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, "+ "):
+		return f.Include(rule[2:])
+	case strings.HasPrefix(rule, "- "):
+		return f.Exclude(rule[2:])
+	}
+	return fmt.Errorf("invalid filter rule '%s': expected '+ <pattern>' or '- <pattern>'", rule)
+}
+
+// AddRulesFromFile adds rules from the file, one rule per line (see AddRule).
+// Empty lines and lines starting with "#" are ignored.
+func (f *Filter) AddRulesFromFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.AddRule(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", filePath, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (f *Filter) addRule(include bool, pattern string) error {
+	rule := filterRule{
+		include: include,
+		pattern: pattern,
+	}
+
+	var expr string
+	if strings.HasPrefix(pattern, "re:") {
+		expr = pattern[3:]
+	} else {
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		switch {
+		case strings.HasPrefix(pattern, "/"):
+			expr = "^" + globToRegexp(pattern[1:]) + "$"
+		case strings.Contains(pattern, "/"):
+			// like in rsync, an inner slash anchors the pattern as well
+			expr = "^" + globToRegexp(pattern) + "$"
+		default:
+			expr = "(^|/)" + globToRegexp(pattern) + "$"
+		}
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s': %w", rule.pattern, err)
+	}
+	rule.re = re
+	f.rules = append(f.rules, rule)
+	return nil
+}
+
+func globToRegexp(pattern string) string {
+	var result strings.Builder
+	for idx := 0; idx < len(pattern); idx++ {
+		c := pattern[idx]
+		switch c {
+		case '*':
+			if idx+1 < len(pattern) && pattern[idx+1] == '*' {
+				result.WriteString(".*")
+				idx++
+				continue
+			}
+			result.WriteString("[^/]*")
+		case '?':
+			result.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[idx+1:], ']')
+			if end < 0 {
+				result.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[idx+1 : idx+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			result.WriteString("[" + class + "]")
+			idx += end + 1
+		default:
+			result.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return result.String()
+}
+
+// isIncluded returns the verdict of the first rule matching the path itself.
+func (f *Filter) isIncluded(relPath string, isDir bool) bool {
+	for _, rule := range f.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			return rule.include
+		}
+	}
+	return true
+}
+
+// IsExcluded returns true if the path (relative to the root) should be
+// skipped. A nil filter excludes nothing.
+func (f *Filter) IsExcluded(relPath string, isDir bool) bool {
+	if f == nil || len(f.rules) == 0 {
+		return false
+	}
+
+	// checking the parent directories first
+	for idx := 0; idx < len(relPath); idx++ {
+		if relPath[idx] != '/' {
+			continue
+		}
+		if !f.isIncluded(relPath[:idx], true) {
+			return true
+		}
+	}
+
+	return !f.isIncluded(relPath, isDir)
+}
@@ -0,0 +1,163 @@
+package slowsync
+
+import (
+	"testing"
+)
+
+func TestFilterIsExcluded(t *testing.T) {
+	type check struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}
+	for _, tc := range []struct {
+		name   string
+		rules  []string
+		checks []check
+	}{
+		{
+			name:  "no rules",
+			rules: nil,
+			checks: []check{
+				{"a", false, false},
+				{"a/b/c", true, false},
+			},
+		},
+		{
+			name:  "name at any depth",
+			rules: []string{"- *.tmp"},
+			checks: []check{
+				{"x.tmp", false, true},
+				{"a/b/x.tmp", false, true},
+				{"a/x.tmp/y", false, true},
+				{"x.tmpl", false, false},
+				{"a.tmp.b", false, false},
+			},
+		},
+		{
+			name:  "anchored by the leading slash",
+			rules: []string{"- /foo"},
+			checks: []check{
+				{"foo", false, true},
+				{"foo/bar", false, true},
+				{"a/foo", false, false},
+			},
+		},
+		{
+			name:  "anchored by an inner slash",
+			rules: []string{"- foo/bar"},
+			checks: []check{
+				{"foo/bar", false, true},
+				{"foo/bar/baz", false, true},
+				{"a/foo/bar", false, false},
+				{"foo/barbaz", false, false},
+			},
+		},
+		{
+			name:  "anchored by an inner slash with a trailing slash",
+			rules: []string{"- foo/bar/"},
+			checks: []check{
+				{"foo/bar", true, true},
+				{"foo/bar", false, false},
+				{"a/foo/bar", true, false},
+			},
+		},
+		{
+			name:  "directories only",
+			rules: []string{"- cache/"},
+			checks: []check{
+				{"cache", true, true},
+				{"cache", false, false},
+				{"a/cache", true, true},
+				{"a/cache/file", false, true},
+			},
+		},
+		{
+			name:  "single star does not cross slashes",
+			rules: []string{"- /a/*/c"},
+			checks: []check{
+				{"a/b/c", false, true},
+				{"a/b/b/c", false, false},
+			},
+		},
+		{
+			name:  "double star crosses slashes",
+			rules: []string{"- /a/**/c"},
+			checks: []check{
+				{"a/b/c", false, true},
+				{"a/b/b/c", false, true},
+				{"x/a/b/c", false, false},
+			},
+		},
+		{
+			name:  "question mark and character classes",
+			rules: []string{"- file?.[0-9]", "- log[!a-z]"},
+			checks: []check{
+				{"file1.5", false, true},
+				{"file/.5", false, false},
+				{"file1.x", false, false},
+				{"log1", false, true},
+				{"logx", false, false},
+			},
+		},
+		{
+			name:  "the first matching rule wins",
+			rules: []string{"+ keep.tmp", "- *.tmp"},
+			checks: []check{
+				{"keep.tmp", false, false},
+				{"a/keep.tmp", false, false},
+				{"drop.tmp", false, true},
+			},
+		},
+		{
+			name:  "an excluded directory excludes its contents",
+			rules: []string{"+ *.go", "- /vendor/"},
+			checks: []check{
+				{"vendor/x.go", false, true},
+				{"src/x.go", false, false},
+			},
+		},
+		{
+			name:  "regular expression",
+			rules: []string{"- re:^a/[0-9]+$"},
+			checks: []check{
+				{"a/123", false, true},
+				{"a/12x", false, false},
+				{"b/a/123", false, false},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewFilter()
+			for _, rule := range tc.rules {
+				if err := f.AddRule(rule); err != nil {
+					t.Fatalf("unable to add rule '%s': %v", rule, err)
+				}
+			}
+			for _, c := range tc.checks {
+				if excluded := f.IsExcluded(c.path, c.isDir); excluded != c.excluded {
+					t.Errorf("IsExcluded(%q, %v) = %v, expected %v", c.path, c.isDir, excluded, c.excluded)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterNil(t *testing.T) {
+	var f *Filter
+	if f.IsExcluded("a/b", false) {
+		t.Errorf("a nil filter excludes a path")
+	}
+}
+
+func TestFilterAddRuleInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"foo",
+		"+foo",
+		"- re:(",
+	} {
+		if err := NewFilter().AddRule(rule); err == nil {
+			t.Errorf("AddRule(%q) succeeded, expected an error", rule)
+		}
+	}
+}
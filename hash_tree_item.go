@@ -30,7 +30,7 @@ func unixTimeParse(s string) (time.Time, error) {
 
 func ParseHashTreeItem(s string) (*HashTreeItem, error) {
 	parts := strings.SplitN(s, "\t", 7)
-	if parts[0] != "hash" {
+	if len(parts) != 7 || parts[0] != "hash" {
 		return nil, fmt.Errorf("is not a hash line")
 	}
 	digest, err := hex.DecodeString(parts[1])
@@ -0,0 +1,238 @@
+package slowsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const aclXAttrPrefix = "system.posix_acl_"
+
+// MetadataOptions defines which metadata of files and directories to
+// copy to the destination.
+type MetadataOptions struct {
+	Mode   bool
+	Owner  bool // applied only when running as root
+	Times  bool // atime and mtime
+	XAttrs bool // extended attributes, except ACLs
+	ACLs   bool // POSIX ACLs
+}
+
+// ParseMetadataOptions parses a comma-separated list of: mode, owner,
+// times, xattrs, acls, all.
+func ParseMetadataOptions(s string) (MetadataOptions, error) {
+	var opts MetadataOptions
+	for _, word := range strings.Split(s, ",") {
+		switch strings.TrimSpace(word) {
+		case "":
+		case "mode":
+			opts.Mode = true
+		case "owner":
+			opts.Owner = true
+		case "times":
+			opts.Times = true
+		case "xattrs":
+			opts.XAttrs = true
+		case "acls":
+			opts.ACLs = true
+		case "all":
+			opts = MetadataOptions{Mode: true, Owner: true, Times: true, XAttrs: true, ACLs: true}
+		default:
+			return MetadataOptions{}, fmt.Errorf("unknown metadata '%s'", word)
+		}
+	}
+	return opts, nil
+}
+
+func (opts MetadataOptions) Enabled() bool {
+	return opts.Mode || opts.Owner || opts.Times || opts.XAttrs || opts.ACLs
+}
+
+// newCommitOptions returns the options to commit a copy of src with, which
+// apply the metadata (if enabled) before the copy is renamed into place.
+// src is lstat-ed here, thus it should be called before reading the file.
+func newCommitOptions(src string, opts MetadataOptions, fsyncDir bool) (commitOptions, error) {
+	commit := commitOptions{fsyncDir: fsyncDir}
+	if !opts.Enabled() {
+		return commit, nil
+	}
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return commit, err
+	}
+	commit.prepare = func(filePath string) error {
+		if err := applyMetadata(src, filePath, srcInfo, opts); err != nil {
+			return fmt.Errorf("unable to preserve metadata: %w", err)
+		}
+		return nil
+	}
+	return commit, nil
+}
+
+// applyMetadata copies the metadata of src (described by srcInfo, which
+// should be taken before reading the file, to get the original atime) to dst.
+func applyMetadata(src, dst string, srcInfo os.FileInfo, opts MetadataOptions) error {
+	var result *multierror.Error
+
+	stat, _ := srcInfo.Sys().(*syscall.Stat_t)
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		// the other calls would follow the symlink
+		if opts.Owner && stat != nil && os.Geteuid() == 0 {
+			if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opts.Owner && stat != nil && os.Geteuid() == 0 {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	// after chown, since it clears security.capability
+	if opts.XAttrs || opts.ACLs {
+		if err := copyXAttrs(src, dst, opts); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	// after chown, since it resets setuid/setgid bits
+	if opts.Mode {
+		if err := os.Chmod(dst, srcInfo.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if opts.Times && stat != nil {
+		ts := []syscall.Timespec{stat.Atim, stat.Mtim}
+		if err := syscall.UtimesNano(dst, ts); err != nil {
+			result = multierror.Append(result, &os.PathError{Op: "utimes", Path: dst, Err: err})
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func listXAttrs(filePath string) ([]string, error) {
+	size, err := syscall.Listxattr(filePath, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(filePath, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			result = append(result, string(name))
+		}
+	}
+	return result, nil
+}
+
+func getXAttr(filePath, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(filePath, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(filePath, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+func copyXAttrs(src, dst string, opts MetadataOptions) error {
+	names, err := listXAttrs(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return &os.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+
+	var result *multierror.Error
+	for _, name := range names {
+		isACL := strings.HasPrefix(name, aclXAttrPrefix)
+		if (isACL && !opts.ACLs) || (!isACL && !opts.XAttrs) {
+			continue
+		}
+		value, err := getXAttr(src, name)
+		if err != nil {
+			result = multierror.Append(result, &os.PathError{Op: "getxattr " + name, Path: src, Err: err})
+			continue
+		}
+		if err := syscall.Setxattr(dst, name, value, 0); err != nil {
+			result = multierror.Append(result, &os.PathError{Op: "setxattr " + name, Path: dst, Err: err})
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// dirMetadataQueue collects the directories, which metadata should be
+// applied after all the files inside are copied (since copying changes
+// the mtime of a directory).
+type dirMetadataQueue struct {
+	locker sync.Mutex
+	dirs   map[string]struct{}
+}
+
+func newDirMetadataQueue() *dirMetadataQueue {
+	return &dirMetadataQueue{
+		dirs: map[string]struct{}{},
+	}
+}
+
+// AddParents adds all the parent directories of the file (relative to the root).
+func (q *dirMetadataQueue) AddParents(filePath string) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	for dir := filepath.Dir(filePath); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := q.dirs[dir]; ok {
+			break
+		}
+		q.dirs[dir] = struct{}{}
+	}
+}
+
+// Apply applies the metadata to the directories, the deepest ones first.
+func (q *dirMetadataQueue) Apply(srcRootDir, dstRootDir string, opts MetadataOptions) error {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	dirs := make([]string, 0, len(q.dirs))
+	for dir := range q.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+
+	var result *multierror.Error
+	for _, dir := range dirs {
+		srcPath := filepath.Join(srcRootDir, dir)
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		if err := applyMetadata(srcPath, filepath.Join(dstRootDir, dir), srcInfo, opts); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,234 @@
+package slowsync
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTooManyDeletions is reported when the mirror mode is going to delete more than MirrorOptions.MaxDeletions files.
+	ErrTooManyDeletions = errors.New("too many files to delete")
+)
+
+// MirrorOptions defines how to propagate deletions from the source to the destination.
+type MirrorOptions struct {
+	// Enabled makes files, which exist only on the destination, to be deleted.
+	Enabled bool
+
+	// MaxDeletions is the maximal amount of files to delete; if there are
+	// more, then nothing is deleted (and nothing is copied). Zero means no limit.
+	MaxDeletions uint
+
+	// TrashDir, if set, makes the files to be moved into a dated
+	// subdirectory of it instead of deleting them. It should be on the same
+	// filesystem as the destination.
+	TrashDir string
+}
+
+// checkDeletions returns ErrTooManyDeletions if the amount of files to
+// delete exceeds MaxDeletions.
+func (opts MirrorOptions) checkDeletions(count int) error {
+	if opts.MaxDeletions > 0 && uint(count) > opts.MaxDeletions {
+		return fmt.Errorf("%w: %d > %d", ErrTooManyDeletions, count, opts.MaxDeletions)
+	}
+	return nil
+}
+
+func (ft *fileTree) relPath(absPath string) string {
+	rel, err := filepath.Rel(ft.rootPath, absPath)
+	if err != nil {
+		return absPath
+	}
+	return rel
+}
+
+// markDirListed remembers that the directory was completely listed,
+// unless it was already marked as incomplete.
+func (ft *fileTree) markDirListed(dirPath string) {
+	ft.listedDirsLocker.Lock()
+	defer ft.listedDirsLocker.Unlock()
+	if ft.listedDirs == nil {
+		ft.listedDirs = map[string]bool{}
+	}
+	dirPath = ft.relPath(dirPath)
+	if _, ok := ft.listedDirs[dirPath]; !ok {
+		ft.listedDirs[dirPath] = true
+	}
+}
+
+// markDirIncomplete remembers that the content of the directory is not
+// completely known, thus nothing should be deleted from it in the mirror mode.
+func (ft *fileTree) markDirIncomplete(dirPath string) {
+	ft.listedDirsLocker.Lock()
+	defer ft.listedDirsLocker.Unlock()
+	if ft.listedDirs == nil {
+		ft.listedDirs = map[string]bool{}
+	}
+	ft.listedDirs[ft.relPath(dirPath)] = false
+}
+
+// isDirKnownComplete returns true if it is certain that the source has
+// no files in the directory except the scanned ones. If the directory does
+// not exist on the source, then its closest existing parent is checked.
+func (ft *fileTree) isDirKnownComplete(dirPath string) bool {
+	ft.listedDirsLocker.Lock()
+	defer ft.listedDirsLocker.Unlock()
+	for {
+		if complete, ok := ft.listedDirs[dirPath]; ok {
+			return complete
+		}
+		if dirPath == "." || dirPath == "/" {
+			return false
+		}
+		dirPath = filepath.Dir(dirPath)
+	}
+}
+
+func (ft *fileTree) isDirListed(dirPath string) bool {
+	ft.listedDirsLocker.Lock()
+	defer ft.listedDirsLocker.Unlock()
+	_, ok := ft.listedDirs[dirPath]
+	return ok
+}
+
+// filesToDelete returns the files, which exist only on the destination and
+// could be safely deleted.
+func (ft *fileTree) filesToDelete(dstRootDir string, cmp *fileTree, opts MirrorOptions) ([]string, error) {
+	ft.listedDirsLocker.Lock()
+	hasListedDirs := len(ft.listedDirs) > 0
+	ft.listedDirsLocker.Unlock()
+	if !hasListedDirs {
+		log.Println("Syncing: the source directories were not scanned (the file tree is loaded from the cache?), not deleting anything")
+		return nil, nil
+	}
+
+	var trashDirRel string
+	if opts.TrashDir != "" {
+		if trashDir, err := filepath.Abs(opts.TrashDir); err == nil {
+			if rel, err := filepath.Rel(dstRootDir, trashDir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				trashDirRel = rel
+			}
+		}
+	}
+
+	var result []string
+	addDstOnlyFile := func(filePath string) {
+		if isTempFile(filePath) {
+			// removed by removeTempFiles (unless it is a dry run)
+			return
+		}
+		if trashDirRel != "" && (trashDirRel == "." || strings.HasPrefix(filePath, trashDirRel+"/")) {
+			return
+		}
+		if ft.scanOptions.Filter.IsExcluded(filePath, false) {
+			// excluded files are protected from deletion
+			return
+		}
+		if !ft.isDirKnownComplete(filepath.Dir(filePath)) {
+			log.Printf("Syncing: not deleting '%s': the source directory was not scanned completely", filePath)
+			return
+		}
+		result = append(result, filePath)
+	}
+
+	if ft.diskIndex || cmp.diskIndex {
+		err := joinNodes(ft, cmp, func(srcNode, dstNode *node) error {
+			if srcNode == nil {
+				addDstOnlyFile(dstNode.path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to compare the file trees: %w", err)
+		}
+		return result, nil
+	}
+
+	for filePath := range cmp.nodeMap {
+		if _, ok := ft.nodeMap[filePath]; ok {
+			continue
+		}
+		addDstOnlyFile(filePath)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// mirrorDeletions deletes (or moves to the trash directory) the files,
+// which exist only on the destination.
+func (ft *fileTree) mirrorDeletions(dstRootDir string, cmp *fileTree, opts SyncOptions) error {
+	filesToDelete, err := ft.filesToDelete(dstRootDir, cmp, opts.Mirror)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Syncing: to delete report")
+	for _, filePath := range filesToDelete {
+		fmt.Println(filePath)
+	}
+	fmt.Println("Syncing: to delete report -- complete")
+
+	if err := opts.Mirror.checkDeletions(len(filesToDelete)); err != nil {
+		return err
+	}
+	if opts.DryRun || len(filesToDelete) == 0 {
+		return nil
+	}
+
+	log.Println("Syncing: deleting")
+
+	var trashRoot string
+	if opts.Mirror.TrashDir != "" {
+		trashRoot = filepath.Join(opts.Mirror.TrashDir, time.Now().Format("2006-01-02T15-04-05"))
+	}
+
+	dirs := map[string]struct{}{}
+	for _, filePath := range filesToDelete {
+		dstPath := filepath.Join(dstRootDir, filePath)
+		var err error
+		if trashRoot != "" {
+			trashPath := filepath.Join(trashRoot, filePath)
+			err = createDirectory(filepath.Dir(trashPath))
+			if err == nil {
+				err = os.Rename(dstPath, trashPath)
+			}
+		} else {
+			err = os.Remove(dstPath)
+		}
+		if err != nil {
+			err = withPhase(BrokenFilePhaseWrite, fmt.Errorf("unable to delete '%s': %w", dstPath, err))
+			if isFatalDestinationError(err) {
+				return err
+			}
+			if _, err := cmp.addBrokenFile(filePath, err); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Println("deleted file:", filePath)
+		dirs[filepath.Dir(filePath)] = struct{}{}
+	}
+
+	// removing the directories which became empty and do not exist on the source
+	var dirList []string
+	for dir := range dirs {
+		dirList = append(dirList, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirList)))
+	for _, dir := range dirList {
+		for dir != "." && !ft.isDirListed(dir) {
+			if err := os.Remove(filepath.Join(dstRootDir, dir)); err != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	return nil
+}
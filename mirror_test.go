@@ -0,0 +1,199 @@
+package slowsync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newDiskTestFileTree writes the files (path -> content) into a temporary
+// directory and returns a file tree of it with the nodes in the memory index.
+func newDiskTestFileTree(t *testing.T, files map[string]string) *fileTree {
+	t.Helper()
+	ft := &fileTree{
+		rootPath:    t.TempDir(),
+		nodeMap:     map[string]node{},
+		brokenFiles: newBrokenFilesList(),
+	}
+	for filePath, content := range files {
+		fileInfo := writeTestFile(t, ft.rootPath, filePath, content)
+		ft.setNode(newNode(filePath, fileInfo))
+	}
+	return ft
+}
+
+func writeTestFile(t *testing.T, rootPath, filePath, content string) os.FileInfo {
+	t.Helper()
+	fullPath := filepath.Join(rootPath, filePath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Lstat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInfo
+}
+
+// listTestDir returns the paths in the directory (relative to it), with
+// a trailing slash for directories.
+func listTestDir(t *testing.T, rootPath string) []string {
+	t.Helper()
+	var result []string
+	err := filepath.WalkDir(rootPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == rootPath {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, filePath)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			rel += "/"
+		}
+		result = append(result, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func testFiles(paths ...string) map[string]string {
+	files := map[string]string{}
+	for _, filePath := range paths {
+		files[filePath] = filePath
+	}
+	return files
+}
+
+func TestMirrorDeletions(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		src           []string
+		dst           []string
+		listedDirs    map[string]bool
+		rules         []string
+		maxDeletions  uint
+		useTrash      bool
+		dryRun        bool
+		expectedErr   error
+		expectedLeft  []string
+		expectedTrash []string // without the dated subdirectory
+	}{
+		{
+			name:         "destination-only files",
+			src:          []string{"a"},
+			dst:          []string{"a", "b", "d/c"},
+			listedDirs:   map[string]bool{".": true},
+			expectedLeft: []string{"a"},
+		},
+		{
+			name:         "too many deletions",
+			src:          []string{"a"},
+			dst:          []string{"a", "b", "c"},
+			listedDirs:   map[string]bool{".": true},
+			maxDeletions: 1,
+			expectedErr:  ErrTooManyDeletions,
+			expectedLeft: []string{"a", "b", "c"},
+		},
+		{
+			name:         "deletions within the limit",
+			dst:          []string{"b", "c"},
+			listedDirs:   map[string]bool{".": true},
+			maxDeletions: 2,
+		},
+		{
+			name:         "filtered paths are protected",
+			dst:          []string{"a.keep", "b", "cache/c"},
+			listedDirs:   map[string]bool{".": true},
+			rules:        []string{"- *.keep", "- /cache/"},
+			expectedLeft: []string{"a.keep", "cache/", "cache/c"},
+		},
+		{
+			name: "incompletely listed directories",
+			src:  []string{"d/x", "e/x"},
+			dst:  []string{"d/a", "d/sub/b", "e/b", "f/c"},
+			listedDirs: map[string]bool{
+				".": true,
+				"d": false,
+				"e": true,
+			},
+			expectedLeft: []string{"d/", "d/a", "d/sub/", "d/sub/b", "e/"},
+		},
+		{
+			name:         "not scanned source",
+			dst:          []string{"a"},
+			expectedLeft: []string{"a"},
+		},
+		{
+			name:         "dry run",
+			dst:          []string{"a", "d/b"},
+			listedDirs:   map[string]bool{".": true},
+			dryRun:       true,
+			expectedLeft: []string{"a", "d/", "d/b"},
+		},
+		{
+			name:          "trash directory",
+			src:           []string{"a"},
+			dst:           []string{"a", "b", "d/c"},
+			listedDirs:    map[string]bool{".": true},
+			useTrash:      true,
+			expectedLeft:  []string{"a"},
+			expectedTrash: []string{"b", "d/", "d/c"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := newDiskTestFileTree(t, testFiles(tc.src...))
+			dst := newDiskTestFileTree(t, testFiles(tc.dst...))
+			src.listedDirs = tc.listedDirs
+			src.scanOptions.Filter = NewFilter()
+			for _, rule := range tc.rules {
+				if err := src.scanOptions.Filter.AddRule(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := SyncOptions{
+				DryRun: tc.dryRun,
+				Mirror: MirrorOptions{
+					Enabled:      true,
+					MaxDeletions: tc.maxDeletions,
+				},
+			}
+			if tc.useTrash {
+				opts.Mirror.TrashDir = t.TempDir()
+			}
+
+			err := src.mirrorDeletions(dst.rootPath, dst, opts)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("got error %v, expected %v", err, tc.expectedErr)
+			}
+			if left := listTestDir(t, dst.rootPath); !reflect.DeepEqual(left, tc.expectedLeft) {
+				t.Errorf("got files left %q, expected %q", left, tc.expectedLeft)
+			}
+			if !tc.useTrash {
+				return
+			}
+			var trash []string
+			for _, filePath := range listTestDir(t, opts.Mirror.TrashDir) {
+				if idx := strings.Index(filePath, "/"); idx >= 0 && idx < len(filePath)-1 {
+					trash = append(trash, filePath[idx+1:])
+				}
+			}
+			if !reflect.DeepEqual(trash, tc.expectedTrash) {
+				t.Errorf("got files in the trash %q, expected %q", trash, tc.expectedTrash)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package slowsync
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MoveOptions defines how to detect files moved (or renamed) on the source,
+// to move them on the destination instead of copying them again.
+type MoveOptions struct {
+	// Enabled makes source-only files to be matched against destination-only
+	// files by size and then by digest. Matched files are renamed on the
+	// destination in the mirror mode, and hardlinked otherwise. It is not
+	// supported with ScanOptions.DiskIndex.
+	Enabled bool
+
+	// SrcHashTreeDB and DstHashTreeDB are paths to SQLite DBs made by
+	// "hashtree -sqlite3db" for the source and the destination. They are
+	// used to avoid reading the files to calculate digests, thus they
+	// are expected to be up to date.
+	SrcHashTreeDB string
+	DstHashTreeDB string
+}
+
+// hashTreeDB is a hash tree stored by "hashtree -sqlite3db".
+type hashTreeDB struct {
+	db *sql.DB
+}
+
+func openHashTreeDB(dbPath string) (*hashTreeDB, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?cache=shared&mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open '%s': %w", dbPath, err)
+	}
+	db.SetMaxOpenConns(1)
+	return &hashTreeDB{db: db}, nil
+}
+
+func (h *hashTreeDB) Close() error {
+	return h.db.Close()
+}
+
+// Digest returns the digest of the file, if the file is in the DB and has the expected size.
+func (h *hashTreeDB) Digest(filePath string, size int64) ([]byte, error) {
+	var digest []byte
+	var dbSize int64
+	err := h.db.QueryRow(`SELECT digest, size FROM hash_tree WHERE path = ?`, filePath).Scan(&digest, &dbSize)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case dbSize != size:
+		// the DB is outdated
+		return nil, nil
+	}
+	return digest, nil
+}
+
+// Sizes returns all the file sizes in the DB.
+func (h *hashTreeDB) Sizes() (map[int64]struct{}, error) {
+	rows, err := h.db.Query(`SELECT DISTINCT size FROM hash_tree`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int64]struct{}{}
+	for rows.Next() {
+		var size int64
+		if err := rows.Scan(&size); err != nil {
+			return nil, err
+		}
+		result[size] = struct{}{}
+	}
+	return result, rows.Err()
+}
+
+// PathsByDigest returns the files with the digest and the size.
+func (h *hashTreeDB) PathsByDigest(digest []byte, size int64) ([]string, error) {
+	rows, err := h.db.Query(`SELECT path FROM hash_tree WHERE digest = ? AND size = ?`, digest, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			return nil, err
+		}
+		result = append(result, filePath)
+	}
+	return result, rows.Err()
+}
+
+// moveDetector finds destination files with the same content as source files.
+type moveDetector struct {
+	src, dst     *fileTree
+	srcDB, dstDB *hashTreeDB
+
+	// dstOnlyBySize are the files which exist only on the destination
+	dstOnlyBySize map[int64][]string
+}
+
+func (d *moveDetector) srcDigest(n node) []byte {
+	if d.srcDB != nil {
+		digest, err := d.srcDB.Digest(n.path, n.size)
+		if err != nil {
+			log.Printf("unable to get the digest of '%s' from the source hash tree DB: %v", n.path, err)
+		}
+		if digest != nil {
+			return digest
+		}
+	}
+	digest, err := d.src.nodeDigest(n, digestKindFull)
+	if err != nil {
+		log.Printf("unable to calculate the digest of the source file '%s': %v", n.path, err)
+	}
+	return digest
+}
+
+func (d *moveDetector) dstDigest(filePath string) []byte {
+	n := d.dst.nodeMap[filePath]
+	if d.dstDB != nil {
+		digest, err := d.dstDB.Digest(filePath, n.size)
+		if err != nil {
+			log.Printf("unable to get the digest of '%s' from the destination hash tree DB: %v", filePath, err)
+		}
+		if digest != nil {
+			return digest
+		}
+	}
+	digest, err := d.dst.nodeDigest(n, digestKindFull)
+	if err != nil {
+		log.Printf("unable to calculate the digest of the destination file '%s': %v", filePath, err)
+	}
+	return digest
+}
+
+// Find returns a destination-only file with the same content as the source file.
+func (d *moveDetector) Find(srcNode node) (string, bool) {
+	candidates := d.dstOnlyBySize[srcNode.size]
+	if len(candidates) == 0 {
+		return "", false
+	}
+	srcDigest := d.srcDigest(srcNode)
+	if srcDigest == nil {
+		return "", false
+	}
+
+	if d.dstDB != nil {
+		paths, err := d.dstDB.PathsByDigest(srcDigest, srcNode.size)
+		if err != nil {
+			log.Printf("unable to find files by digest in the destination hash tree DB: %v", err)
+		}
+		for _, filePath := range paths {
+			for _, candidate := range candidates {
+				if candidate == filePath {
+					return filePath, true
+				}
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if bytes.Equal(d.dstDigest(candidate), srcDigest) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+type fileMove struct {
+	from, to string
+	rename   bool
+}
+
+// detectMoves finds the files to copy which already exist on the destination
+// under another path, and moves (or hardlinks) them instead. It returns
+// the files which still need to be copied. The moves done are counted to
+// the result.
+func (ft *fileTree) detectMoves(dstRootDir string, cmp *fileTree, filesToCopy []string, opts SyncOptions, result *SyncResult) ([]string, error) {
+	d := &moveDetector{
+		src:           ft,
+		dst:           cmp,
+		dstOnlyBySize: map[int64][]string{},
+	}
+	if opts.Moves.SrcHashTreeDB != "" {
+		db, err := openHashTreeDB(opts.Moves.SrcHashTreeDB)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the source hash tree DB: %w", err)
+		}
+		defer db.Close()
+		d.srcDB = db
+	}
+	if opts.Moves.DstHashTreeDB != "" {
+		db, err := openHashTreeDB(opts.Moves.DstHashTreeDB)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the destination hash tree DB: %w", err)
+		}
+		defer db.Close()
+		d.dstDB = db
+	}
+
+	for filePath, n := range cmp.nodeMap {
+		if _, ok := ft.nodeMap[filePath]; ok || n.size == 0 || !n.mode.IsRegular() {
+			continue
+		}
+		if ft.scanOptions.Filter.IsExcluded(filePath, false) {
+			continue
+		}
+		d.dstOnlyBySize[n.size] = append(d.dstOnlyBySize[n.size], filePath)
+	}
+	for size := range d.dstOnlyBySize {
+		sort.Strings(d.dstOnlyBySize[size])
+	}
+
+	var moves []fileMove
+	var rest []string
+	renamed := map[string]string{}
+	for _, filePath := range filesToCopy {
+		srcNode := ft.nodeMap[filePath]
+		if _, ok := cmp.nodeMap[filePath]; ok || srcNode.size == 0 || !srcNode.mode.IsRegular() {
+			rest = append(rest, filePath)
+			continue
+		}
+		from, ok := d.Find(srcNode)
+		if !ok {
+			rest = append(rest, filePath)
+			continue
+		}
+
+		move := fileMove{from: from, to: filePath}
+		if newPath, ok := renamed[from]; ok {
+			// already moved by a previous match
+			move.from = newPath
+		} else if opts.Mirror.Enabled && ft.isDirKnownComplete(filepath.Dir(from)) {
+			// the old path would be deleted by the mirror mode anyway
+			move.rename = true
+			renamed[from] = filePath
+		}
+		moves = append(moves, move)
+	}
+
+	fmt.Println("Syncing: to move report")
+	for _, move := range moves {
+		fmt.Println(move.from, "->", move.to)
+	}
+	fmt.Println("Syncing: to move report -- complete")
+
+	// the index is updated only for the moves done, otherwise the mirror
+	// mode would forget the old path of a failed move
+	applyMove := func(move fileMove) {
+		dstNode := cmp.nodeMap[move.from]
+		dstNode.path = move.to
+		if move.rename {
+			delete(cmp.nodeMap, move.from)
+		}
+		cmp.nodeMap[move.to] = dstNode
+	}
+	if opts.DryRun {
+		for _, move := range moves {
+			applyMove(move)
+		}
+		result.Skipped += uint64(len(moves))
+		return rest, nil
+	}
+
+	for _, move := range moves {
+		if err := moveFile(dstRootDir, move); err != nil {
+			if isFatalDestinationError(err) {
+				return nil, withPhase(BrokenFilePhaseWrite, err)
+			}
+			log.Printf("Syncing: unable to move '%s' to '%s', going to copy it instead: %v", move.from, move.to, err)
+			rest = append(rest, move.to)
+			continue
+		}
+		applyMove(move)
+		if move.rename {
+			result.Moved++
+			fmt.Println("moved file:", move.from, "->", move.to)
+		} else {
+			result.Linked++
+			fmt.Println("linked file:", move.from, "->", move.to)
+		}
+	}
+	sort.Strings(rest)
+	return rest, nil
+}
+
+func moveFile(dstRootDir string, move fileMove) error {
+	from := filepath.Join(dstRootDir, move.from)
+	to := filepath.Join(dstRootDir, move.to)
+	if err := createDirectory(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if !move.rename {
+		return os.Link(from, to)
+	}
+	if _, err := os.Lstat(to); !os.IsNotExist(err) {
+		return fmt.Errorf("'%s' already exists", to)
+	}
+	return os.Rename(from, to)
+}
@@ -0,0 +1,188 @@
+package slowsync
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// prepareTestSync makes the trees of newDiskTestFileTree to look like
+// completely scanned ones, to sync them.
+func prepareTestSync(src, dst *fileTree) {
+	for _, ft := range []*fileTree{src, dst} {
+		ft.semaphore = semaphore.NewWeighted(16)
+		ft.nodeChan = make(chan node, len(ft.nodeMap))
+		for _, n := range ft.nodeMap {
+			ft.nodeChan <- n
+		}
+		close(ft.nodeChan)
+	}
+}
+
+func TestDetectMoves(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		src        map[string]string
+		dst        map[string]string
+		dstOnDisk  map[string]string // not in the index of the destination
+		listedDirs map[string]bool
+		mirror     bool
+		dryRun     bool
+
+		expectedRest   []string
+		expectedLeft   []string
+		expectedIndex  []string
+		expectedResult SyncResult
+	}{
+		{
+			name:           "renamed, matched by size and then by digest",
+			src:            map[string]string{"new": "hello"},
+			dst:            map[string]string{"old": "hello", "other": "world"},
+			listedDirs:     map[string]bool{".": true},
+			mirror:         true,
+			expectedLeft:   []string{"new", "other"},
+			expectedIndex:  []string{"new", "other"},
+			expectedResult: SyncResult{Moved: 1},
+		},
+		{
+			name:          "same size, different content",
+			src:           map[string]string{"new": "aaaaa"},
+			dst:           map[string]string{"old": "bbbbb"},
+			listedDirs:    map[string]bool{".": true},
+			mirror:        true,
+			expectedRest:  []string{"new"},
+			expectedLeft:  []string{"old"},
+			expectedIndex: []string{"old"},
+		},
+		{
+			name:          "empty files are not matched",
+			src:           map[string]string{"new": ""},
+			dst:           map[string]string{"old": ""},
+			listedDirs:    map[string]bool{".": true},
+			mirror:        true,
+			expectedRest:  []string{"new"},
+			expectedLeft:  []string{"old"},
+			expectedIndex: []string{"old"},
+		},
+		{
+			name:           "hardlinked without the mirror mode",
+			src:            map[string]string{"new": "hello"},
+			dst:            map[string]string{"old": "hello"},
+			listedDirs:     map[string]bool{".": true},
+			expectedLeft:   []string{"new", "old"},
+			expectedIndex:  []string{"new", "old"},
+			expectedResult: SyncResult{Linked: 1},
+		},
+		{
+			name:           "hardlinked from an incompletely listed directory",
+			src:            map[string]string{"new": "hello"},
+			dst:            map[string]string{"d/old": "hello"},
+			listedDirs:     map[string]bool{".": true, "d": false},
+			mirror:         true,
+			expectedLeft:   []string{"d/", "d/old", "new"},
+			expectedIndex:  []string{"d/old", "new"},
+			expectedResult: SyncResult{Linked: 1},
+		},
+		{
+			name:       "ambiguous candidates",
+			src:        map[string]string{"n1": "same", "n2": "same"},
+			dst:        map[string]string{"o1": "same", "o2": "same"},
+			listedDirs: map[string]bool{".": true},
+			mirror:     true,
+			// the first candidate is renamed, and then linked to
+			expectedLeft:   []string{"n1", "n2", "o2"},
+			expectedIndex:  []string{"n1", "n2", "o2"},
+			expectedResult: SyncResult{Moved: 1, Linked: 1},
+		},
+		{
+			name:          "failed move",
+			src:           map[string]string{"x/new": "hello"},
+			dst:           map[string]string{"old": "hello"},
+			dstOnDisk:     map[string]string{"x": "not a directory"},
+			listedDirs:    map[string]bool{".": true},
+			mirror:        true,
+			expectedRest:  []string{"x/new"},
+			expectedLeft:  []string{"old", "x"},
+			expectedIndex: []string{"old"},
+		},
+		{
+			name:           "dry run",
+			src:            map[string]string{"new": "hello"},
+			dst:            map[string]string{"old": "hello"},
+			listedDirs:     map[string]bool{".": true},
+			mirror:         true,
+			dryRun:         true,
+			expectedLeft:   []string{"old"},
+			expectedIndex:  []string{"new"},
+			expectedResult: SyncResult{Skipped: 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := newDiskTestFileTree(t, tc.src)
+			dst := newDiskTestFileTree(t, tc.dst)
+			src.listedDirs = tc.listedDirs
+			for filePath, content := range tc.dstOnDisk {
+				writeTestFile(t, dst.rootPath, filePath, content)
+			}
+
+			var filesToCopy []string
+			for filePath := range src.nodeMap {
+				if _, ok := dst.nodeMap[filePath]; !ok {
+					filesToCopy = append(filesToCopy, filePath)
+				}
+			}
+			sort.Strings(filesToCopy)
+
+			opts := SyncOptions{
+				DryRun: tc.dryRun,
+				Mirror: MirrorOptions{Enabled: tc.mirror},
+				Moves:  MoveOptions{Enabled: true},
+			}
+			var result SyncResult
+			rest, err := src.detectMoves(dst.rootPath, dst, filesToCopy, opts, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rest, tc.expectedRest) {
+				t.Errorf("got files to copy %q, expected %q", rest, tc.expectedRest)
+			}
+			if left := listTestDir(t, dst.rootPath); !reflect.DeepEqual(left, tc.expectedLeft) {
+				t.Errorf("got files %q, expected %q", left, tc.expectedLeft)
+			}
+			var index []string
+			for filePath := range dst.nodeMap {
+				index = append(index, filePath)
+			}
+			sort.Strings(index)
+			if !reflect.DeepEqual(index, tc.expectedIndex) {
+				t.Errorf("got the destination index %q, expected %q", index, tc.expectedIndex)
+			}
+			if result != tc.expectedResult {
+				t.Errorf("got result %+v, expected %+v", result, tc.expectedResult)
+			}
+		})
+	}
+}
+
+func TestSyncToMovesMaxDeletions(t *testing.T) {
+	src := newDiskTestFileTree(t, map[string]string{"new1": "a1", "new2": "a2"})
+	dst := newDiskTestFileTree(t, map[string]string{"old1": "a1", "old2": "a2", "gone": "x"})
+	src.listedDirs = map[string]bool{".": true}
+	prepareTestSync(src, dst)
+
+	// the renamed files are counted as deleted from their old paths
+	_, err := src.SyncTo(dst, nil, SyncOptions{
+		Mirror: MirrorOptions{Enabled: true, MaxDeletions: 2},
+		Moves:  MoveOptions{Enabled: true},
+	})
+	if !errors.Is(err, ErrTooManyDeletions) {
+		t.Fatalf("got error %v, expected %v", err, ErrTooManyDeletions)
+	}
+	expected := []string{"gone", "old1", "old2"}
+	if left := listTestDir(t, dst.rootPath); !reflect.DeepEqual(left, expected) {
+		t.Errorf("got files %q, expected %q", left, expected)
+	}
+}
@@ -0,0 +1,222 @@
+package slowsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+var (
+	// ErrDiskIndexWithoutCache is reported when ScanOptions.DiskIndex is set
+	// for a file tree without a cache.
+	ErrDiskIndexWithoutCache = errors.New("the disk index requires the file tree cache")
+)
+
+// getNode returns the node of the file from the index: the memory one,
+// or the cache if the disk index is enabled.
+func (ft *fileTree) getNode(filePath string) (node, bool) {
+	if !ft.diskIndex {
+		ft.nodeMapMutex.Lock()
+		defer ft.nodeMapMutex.Unlock()
+		n, ok := ft.nodeMap[filePath]
+		return n, ok
+	}
+
+	nodes, err := ft.queryCachedNodes("WHERE path = ?", filePath)
+	if err != nil {
+		log.Printf("unable to look up '%s' in the cache: %v", filePath, err)
+		return node{}, false
+	}
+	if len(nodes) == 0 {
+		return node{}, false
+	}
+	return nodes[0], true
+}
+
+// setNode stores the node to the memory index. With the disk index it does
+// nothing: the node is already stored to the cache by addNode (and its
+// digests by updateCachedDigests).
+func (ft *fileTree) setNode(n node) {
+	if ft.diskIndex {
+		return
+	}
+	ft.nodeMapMutex.Lock()
+	ft.nodeMap[n.path] = n
+	ft.nodeMapMutex.Unlock()
+}
+
+// deleteNode removes the file from the index.
+func (ft *fileTree) deleteNode(filePath string) {
+	if !ft.diskIndex {
+		ft.nodeMapMutex.Lock()
+		delete(ft.nodeMap, filePath)
+		ft.nodeMapMutex.Unlock()
+		return
+	}
+
+	ft.cacheDBTXLocker.Lock()
+	defer ft.cacheDBTXLocker.Unlock()
+	var err error
+	if ft.cacheDBTX != nil {
+		_, err = ft.cacheDBTX.Exec(`DELETE FROM file_tree WHERE path = ?`, filePath)
+	} else {
+		_, err = ft.cacheDB.Exec(`DELETE FROM file_tree WHERE path = ?`, filePath)
+	}
+	if err != nil {
+		log.Printf("unable to delete '%s' from the cache: %v", filePath, err)
+	}
+}
+
+// forEachNode calls the callback for every node of the index, in the order
+// of paths. The memory index is copied and sorted first.
+func (ft *fileTree) forEachNode(callback func(node) error) error {
+	if ft.diskIndex {
+		return ft.forEachCachedNode(callback)
+	}
+
+	ft.nodeMapMutex.Lock()
+	nodes := make([]node, 0, len(ft.nodeMap))
+	for _, n := range ft.nodeMap {
+		nodes = append(nodes, n)
+	}
+	ft.nodeMapMutex.Unlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].path < nodes[j].path
+	})
+
+	for _, n := range nodes {
+		if err := callback(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errJoinStopped = errors.New("the join is stopped")
+
+// joinNodes is a sorted merge-join of the nodes of the trees: the callback
+// is called for every path of either tree in the order of paths, a node
+// missing in one of the trees is nil. Thus the trees are compared without
+// looking up every path.
+func joinNodes(src, dst *fileTree, callback func(srcNode, dstNode *node) error) error {
+	dstCh := make(chan node, cacheReadBatchSize)
+	stopCh := make(chan struct{})
+	var dstErr error
+	go func() {
+		defer close(dstCh)
+		dstErr = dst.forEachNode(func(n node) error {
+			select {
+			case dstCh <- n:
+				return nil
+			case <-stopCh:
+				return errJoinStopped
+			}
+		})
+	}()
+	defer func() {
+		close(stopCh)
+		for range dstCh {
+		}
+	}()
+
+	dstNode, dstOK := <-dstCh
+	err := src.forEachNode(func(srcNode node) error {
+		for dstOK && dstNode.path < srcNode.path {
+			n := dstNode
+			if err := callback(nil, &n); err != nil {
+				return err
+			}
+			dstNode, dstOK = <-dstCh
+		}
+		if dstOK && dstNode.path == srcNode.path {
+			n := dstNode
+			dstNode, dstOK = <-dstCh
+			return callback(&srcNode, &n)
+		}
+		return callback(&srcNode, nil)
+	})
+	if err != nil {
+		return err
+	}
+	for ; dstOK; dstNode, dstOK = <-dstCh {
+		n := dstNode
+		if err := callback(nil, &n); err != nil {
+			return err
+		}
+	}
+	// dstCh is closed, thus dstErr is set
+	if dstErr != nil {
+		return fmt.Errorf("unable to read the destination index: %w", dstErr)
+	}
+	return nil
+}
+
+// pathSpool is a list of paths stored in an unlinked temporary file, to not
+// keep hundreds of millions of paths in the memory.
+type pathSpool struct {
+	file   *os.File
+	writer *bufio.Writer
+	len    int
+}
+
+func newPathSpool() (*pathSpool, error) {
+	file, err := os.CreateTemp("", "slowsync-paths-")
+	if err != nil {
+		return nil, err
+	}
+	// the file is kept open, and is freed on Close or exit
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &pathSpool{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (s *pathSpool) Add(filePath string) error {
+	s.len++
+	// paths could have any bytes except NUL
+	if _, err := s.writer.WriteString(filePath); err != nil {
+		return err
+	}
+	return s.writer.WriteByte(0)
+}
+
+func (s *pathSpool) Len() int {
+	return s.len
+}
+
+// ForEach calls the callback for every path in the order they were added.
+func (s *pathSpool) ForEach(callback func(filePath string) error) error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer s.file.Seek(0, io.SeekEnd)
+
+	reader := bufio.NewReader(s.file)
+	for {
+		filePath, err := reader.ReadString(0)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		if err := callback(filePath[:len(filePath)-1]); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *pathSpool) Close() error {
+	return s.file.Close()
+}
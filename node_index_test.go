@@ -0,0 +1,207 @@
+package slowsync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestFileTree returns a file tree with the nodes of the paths in the
+// memory index, or in the cache if diskIndex is set.
+func newTestFileTree(t *testing.T, paths []string, diskIndex bool) *fileTree {
+	t.Helper()
+	ft := &fileTree{
+		nodeMap:   map[string]node{},
+		diskIndex: diskIndex,
+	}
+	if diskIndex {
+		ft.cachePath = filepath.Join(t.TempDir(), "cache.db")
+		var err error
+		ft.cacheDB, err = sql.Open("sqlite3", "file:"+ft.cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft.cacheDB.SetMaxOpenConns(1)
+		t.Cleanup(func() { ft.cacheDB.Close() })
+		if _, err := ft.migrateCache(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for idx, filePath := range paths {
+		n := node{path: filePath, size: int64(idx)}
+		if !diskIndex {
+			ft.setNode(n)
+			continue
+		}
+		if _, err := ft.cacheDB.Exec(`INSERT INTO file_tree (path, size) VALUES (?, ?)`, n.path, n.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ft
+}
+
+func TestJoinNodes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src      []string
+		dst      []string
+		expected []string // "<path> <in src><in dst>"
+	}{
+		{
+			name: "both empty",
+		},
+		{
+			name:     "only source",
+			src:      []string{"b", "a"},
+			expected: []string{"a +-", "b +-"},
+		},
+		{
+			name:     "only destination",
+			dst:      []string{"b", "a"},
+			expected: []string{"a -+", "b -+"},
+		},
+		{
+			name:     "equal",
+			src:      []string{"a", "b/c"},
+			dst:      []string{"b/c", "a"},
+			expected: []string{"a ++", "b/c ++"},
+		},
+		{
+			name: "interleaved",
+			src:  []string{"a", "c", "e"},
+			dst:  []string{"b", "c", "d", "f"},
+			expected: []string{
+				"a +-", "b -+", "c ++", "d -+", "e +-", "f -+",
+			},
+		},
+		{
+			name: "missing at both ends",
+			src:  []string{"b", "c"},
+			dst:  []string{"a", "c", "d"},
+			expected: []string{
+				"a -+", "b +-", "c ++", "d -+",
+			},
+		},
+		{
+			name: "byte order of separators",
+			src:  []string{"a/b", "a"},
+			dst:  []string{"a.b", "a/b"},
+			expected: []string{
+				"a +-", "a.b -+", "a/b ++",
+			},
+		},
+	} {
+		for _, diskIndex := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/diskIndex=%v", tc.name, diskIndex), func(t *testing.T) {
+				src := newTestFileTree(t, tc.src, diskIndex)
+				dst := newTestFileTree(t, tc.dst, diskIndex)
+
+				var result []string
+				err := joinNodes(src, dst, func(srcNode, dstNode *node) error {
+					var filePath string
+					flags := []byte("--")
+					if srcNode != nil {
+						filePath = srcNode.path
+						flags[0] = '+'
+					}
+					if dstNode != nil {
+						if srcNode != nil && dstNode.path != srcNode.path {
+							t.Errorf("joined different paths: '%s' and '%s'", srcNode.path, dstNode.path)
+						}
+						filePath = dstNode.path
+						flags[1] = '+'
+					}
+					result = append(result, filePath+" "+string(flags))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(result, tc.expected) {
+					t.Errorf("got %q, expected %q", result, tc.expected)
+				}
+			})
+		}
+	}
+}
+
+func TestJoinNodesStop(t *testing.T) {
+	// more than the buffer of the destination nodes, so the reader of
+	// the destination is blocked when the join is stopped
+	var dstPaths []string
+	for idx := 0; idx < cacheReadBatchSize*2; idx++ {
+		dstPaths = append(dstPaths, fmt.Sprintf("%08d", idx))
+	}
+	src := newTestFileTree(t, []string{"a"}, false)
+	dst := newTestFileTree(t, dstPaths, false)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := joinNodes(src, dst, func(srcNode, dstNode *node) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("got error %v, expected %v", err, errStop)
+	}
+	if calls != 1 {
+		t.Errorf("the callback is called %d times after an error", calls)
+	}
+}
+
+func TestPathSpool(t *testing.T) {
+	spool, err := newPathSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	readAll := func() []string {
+		var result []string
+		if err := spool.ForEach(func(filePath string) error {
+			result = append(result, filePath)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if paths := readAll(); len(paths) != 0 {
+		t.Errorf("an empty spool returned %q", paths)
+	}
+
+	expected := []string{"b", "a", "with\nnewline", "with\ttab", "юникод/файл", "b"}
+	for _, filePath := range expected[:3] {
+		if err := spool.Add(filePath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if paths := readAll(); !reflect.DeepEqual(paths, expected[:3]) {
+		t.Errorf("got %q, expected %q", paths, expected[:3])
+	}
+
+	// adding after reading appends to the end
+	for _, filePath := range expected[3:] {
+		if err := spool.Add(filePath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if paths := readAll(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("got %q, expected %q", paths, expected)
+	}
+	if spool.Len() != len(expected) {
+		t.Errorf("Len() = %d, expected %d", spool.Len(), len(expected))
+	}
+
+	errStop := errors.New("stop")
+	err = spool.ForEach(func(string) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("got error %v, expected %v", err, errStop)
+	}
+}
@@ -0,0 +1,205 @@
+package osrecovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+const (
+	// listBufSize is the size of the buffer passed to getdents64 by the lister
+	listBufSize = 1024
+
+	// the layout of struct linux_dirent64
+	direntOffsetIno    = 0
+	direntOffsetOff    = 8
+	direntOffsetReclen = 16
+	direntOffsetType   = 18
+	direntOffsetName   = 19
+	direntStructSize   = 24 // sizeof(struct linux_dirent64), including the padding
+	direntAlignment    = 8
+
+	// maxDirentRecLen is the maximal d_reclen considered valid while bruteforcing
+	maxDirentRecLen = listBufSize
+
+	// d_type values
+	dtUnknown = 0
+	dtFIFO    = 1
+	dtChr     = 2
+	dtDir     = 4
+	dtBlk     = 6
+	dtReg     = 8
+	dtLnk     = 10
+	dtSock    = 12
+)
+
+var hostByteOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	var i uint16 = 1
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 0 {
+		hostByteOrder = binary.BigEndian
+	}
+}
+
+// DirentsHeuristic defines how to parse a raw getdents64 output, which
+// may be corrupted.
+type DirentsHeuristic string
+
+const (
+	// DirentsHeuristicStrict follows d_reclen and stops on the first invalid one.
+	DirentsHeuristicStrict = DirentsHeuristic("strict")
+
+	// DirentsHeuristicBruteforce follows d_reclen, and on d_reclen == 0
+	// skips the name and then searches byte by byte for something looking
+	// like a valid d_reclen and d_type. This is what the lister does.
+	DirentsHeuristicBruteforce = DirentsHeuristic("bruteforce")
+
+	// DirentsHeuristicScan ignores d_reclen of the previous entries and
+	// tries every offset, accepting only entries which are fully consistent
+	// (aligned d_reclen which matches the name length, valid d_type and
+	// a name without slashes).
+	DirentsHeuristicScan = DirentsHeuristic("scan")
+)
+
+// DirentsHeuristics are all the supported heuristics.
+var DirentsHeuristics = []DirentsHeuristic{
+	DirentsHeuristicStrict,
+	DirentsHeuristicBruteforce,
+	DirentsHeuristicScan,
+}
+
+func direntTypeFromDType(dType uint8) DirEntryType {
+	switch dType {
+	case dtReg:
+		return DirEntryTypeRegular
+	case dtDir:
+		return DirEntryTypeDirectory
+	case dtFIFO:
+		return DirEntryTypeFIFO
+	case dtSock:
+		return DirEntryTypeSocket
+	case dtLnk:
+		return DirEntryTypeSymlink
+	case dtBlk:
+		return DirEntryTypeBlockDevice
+	case dtChr:
+		return DirEntryTypeCharDevice
+	}
+	return DirEntryTypeUnknown
+}
+
+// direntName returns the NUL-terminated name starting at the offset.
+func direntName(buf []byte, offset int) []byte {
+	name := buf[offset:]
+	if idx := bytes.IndexByte(name, 0); idx >= 0 {
+		name = name[:idx]
+	}
+	return name
+}
+
+func readDirent(buf []byte, pos int) DirEntry {
+	return DirEntry{
+		Inode:  hostByteOrder.Uint64(buf[pos+direntOffsetIno:]),
+		Offset: int64(hostByteOrder.Uint64(buf[pos+direntOffsetOff:])),
+		RecLen: hostByteOrder.Uint16(buf[pos+direntOffsetReclen:]),
+		Type:   direntTypeFromDType(buf[pos+direntOffsetType]),
+		Name:   string(direntName(buf, pos+direntOffsetName)),
+	}
+}
+
+// ParseDirents parses the first n bytes of buf, which is the output of
+// a getdents64 call. Fields of an entry may be read beyond n (but within
+// buf), the same way as a C implementation would do.
+func ParseDirents(buf []byte, n int, heuristic DirentsHeuristic) ([]DirEntry, error) {
+	if n > len(buf) {
+		n = len(buf)
+	}
+	switch heuristic {
+	case DirentsHeuristicStrict:
+		return parseDirentsStrict(buf, n), nil
+	case DirentsHeuristicBruteforce:
+		return parseDirentsBruteforce(buf, n), nil
+	case DirentsHeuristicScan:
+		return parseDirentsScan(buf, n), nil
+	}
+	return nil, fmt.Errorf("unknown heuristic '%s'", heuristic)
+}
+
+func parseDirentsStrict(buf []byte, n int) []DirEntry {
+	var result []DirEntry
+	for pos := 0; pos+direntStructSize <= n; {
+		entry := readDirent(buf, pos)
+		if entry.RecLen < direntStructSize || pos+int(entry.RecLen) > n {
+			break
+		}
+		result = append(result, entry)
+		pos += int(entry.RecLen)
+	}
+	return result
+}
+
+func parseDirentsBruteforce(buf []byte, n int) []DirEntry {
+	var result []DirEntry
+	for pos := 0; pos < n; {
+		if pos+direntOffsetName > len(buf) {
+			break
+		}
+		entry := readDirent(buf, pos)
+		result = append(result, entry)
+
+		if entry.RecLen != 0 {
+			pos += int(entry.RecLen)
+			continue
+		}
+
+		// invalid d_reclen, bruteforcing:
+		pos += direntStructSize + len(entry.Name)
+		for pos < n {
+			if pos+direntOffsetName > len(buf) {
+				return result
+			}
+			if int(hostByteOrder.Uint16(buf[pos+direntOffsetReclen:])) > maxDirentRecLen {
+				pos++
+				continue
+			}
+			if direntTypeFromDType(buf[pos+direntOffsetType]) == DirEntryTypeUnknown {
+				pos++
+				continue
+			}
+			break
+		}
+	}
+	return result
+}
+
+func parseDirentsScan(buf []byte, n int) []DirEntry {
+	var result []DirEntry
+	for pos := 0; pos+direntStructSize <= n; pos++ {
+		recLen := int(hostByteOrder.Uint16(buf[pos+direntOffsetReclen:]))
+		if recLen < direntStructSize || recLen%direntAlignment != 0 || pos+recLen > n {
+			continue
+		}
+		dType := buf[pos+direntOffsetType]
+		if dType != dtUnknown && direntTypeFromDType(dType) == DirEntryTypeUnknown {
+			continue
+		}
+		nameLen := bytes.IndexByte(buf[pos+direntOffsetName:pos+recLen], 0)
+		if nameLen <= 0 {
+			continue
+		}
+		// the kernel always makes d_reclen just enough for the name
+		expectedRecLen := (direntOffsetName + nameLen + 1 + direntAlignment - 1) / direntAlignment * direntAlignment
+		if recLen != expectedRecLen {
+			continue
+		}
+		if bytes.IndexByte(buf[pos+direntOffsetName:pos+direntOffsetName+nameLen], '/') >= 0 {
+			continue
+		}
+
+		result = append(result, readDirent(buf, pos))
+		pos += recLen - 1
+	}
+	return result
+}
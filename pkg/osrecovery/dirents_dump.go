@@ -0,0 +1,132 @@
+package osrecovery
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DirentsDumpExt is the extension of dump files in a dump directory.
+const DirentsDumpExt = ".dirents"
+
+// DirentsBuffer is the output of a single getdents64 call.
+type DirentsBuffer struct {
+	// Position is the position in the directory before the call.
+	Position int64
+	Data     []byte
+}
+
+// DirentsDump is everything getdents64 returned while listing a directory.
+type DirentsDump struct {
+	Path    string
+	Buffers []DirentsBuffer
+
+	// Error is the error which finished the listing, if any.
+	Error string
+
+	// Truncated is true if the dump ends abruptly (the lister was killed).
+	Truncated bool
+}
+
+// direntsDumpRecord is a single record of a dump file. Records are
+// written one by one, so that a dump of a lister killed by the watchdog
+// is still readable.
+type direntsDumpRecord struct {
+	Path   string
+	Buffer *DirentsBuffer
+	Error  string
+}
+
+// DirentsDumpPath returns the path of the dump file of the directory in the dump directory.
+func DirentsDumpPath(dumpDir, dirPath string) string {
+	digest := sha1.Sum([]byte(dirPath))
+	return filepath.Join(dumpDir, hex.EncodeToString(digest[:])+DirentsDumpExt)
+}
+
+type direntsDumpWriter struct {
+	file *os.File
+	enc  *gob.Encoder
+}
+
+func newDirentsDumpWriter(dumpPath, dirPath string) (*direntsDumpWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(dumpPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	w := &direntsDumpWriter{
+		file: f,
+		enc:  gob.NewEncoder(f),
+	}
+	if err := w.enc.Encode(direntsDumpRecord{Path: dirPath}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *direntsDumpWriter) WriteBuffer(position int64, data []byte) error {
+	return w.enc.Encode(direntsDumpRecord{Buffer: &DirentsBuffer{Position: position, Data: data}})
+}
+
+func (w *direntsDumpWriter) WriteError(err error) error {
+	return w.enc.Encode(direntsDumpRecord{Error: err.Error()})
+}
+
+func (w *direntsDumpWriter) Close() error {
+	return w.file.Close()
+}
+
+// ReadDirentsDump reads a dump file written by the lister (see ListOptions.DumpDir).
+func ReadDirentsDump(dumpPath string) (*DirentsDump, error) {
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dump := &DirentsDump{}
+	dec := gob.NewDecoder(f)
+	for {
+		var record direntsDumpRecord
+		err := dec.Decode(&record)
+		switch {
+		case err == io.EOF:
+			return dump, nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			dump.Truncated = true
+			return dump, nil
+		case err != nil:
+			return dump, fmt.Errorf("unable to decode '%s': %w", dumpPath, err)
+		}
+		if record.Path != "" {
+			dump.Path = record.Path
+		}
+		if record.Buffer != nil {
+			dump.Buffers = append(dump.Buffers, *record.Buffer)
+		}
+		if record.Error != "" {
+			dump.Error = record.Error
+		}
+	}
+}
+
+// Entries parses the dump using the heuristic.
+func (dump *DirentsDump) Entries(heuristic DirentsHeuristic) ([]DirEntry, error) {
+	var result []DirEntry
+	for _, buf := range dump.Buffers {
+		entries, err := ParseDirents(buf.Data, len(buf.Data), heuristic)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entries...)
+	}
+	return result, nil
+}
@@ -0,0 +1,197 @@
+package osrecovery
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testDirent is a raw linux_dirent64 to build getdents64 buffers of.
+type testDirent struct {
+	ino    uint64
+	off    int64
+	recLen int // zero means the correct one, negative means zero
+	dType  uint8
+	name   string
+}
+
+func (d testDirent) appendTo(buf []byte) []byte {
+	size := (direntOffsetName + len(d.name) + 1 + direntAlignment - 1) / direntAlignment * direntAlignment
+	recLen := d.recLen
+	switch {
+	case recLen == 0:
+		recLen = size
+	case recLen < 0:
+		recLen = 0
+	}
+	raw := make([]byte, size)
+	hostByteOrder.PutUint64(raw[direntOffsetIno:], d.ino)
+	hostByteOrder.PutUint64(raw[direntOffsetOff:], uint64(d.off))
+	hostByteOrder.PutUint16(raw[direntOffsetReclen:], uint16(recLen))
+	raw[direntOffsetType] = d.dType
+	copy(raw[direntOffsetName:], d.name)
+	return append(buf, raw...)
+}
+
+func makeDirents(prefix []byte, dirents ...testDirent) []byte {
+	buf := append([]byte{}, prefix...)
+	for _, d := range dirents {
+		buf = d.appendTo(buf)
+	}
+	return buf
+}
+
+func direntNames(entries []DirEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Name)
+	}
+	return result
+}
+
+func TestParseDirents(t *testing.T) {
+	a := testDirent{ino: 11, off: 1, dType: dtDir, name: "a"}
+	b := testDirent{ino: 12, off: 2, dType: dtReg, name: "bb"}
+	c := testDirent{ino: 13, off: 3, dType: dtLnk, name: "ccc"}
+	zeroRecLen := testDirent{ino: 14, off: 2, recLen: -1, dType: dtReg, name: "zzzzz"}
+	hugeRecLen := testDirent{ino: 15, off: 1, recLen: 4096, dType: dtReg, name: "huge"}
+
+	valid := makeDirents(nil, a, b, c)
+	for _, tc := range []struct {
+		name     string
+		buf      []byte
+		n        int
+		expected map[DirentsHeuristic][]string
+	}{
+		{
+			name: "valid",
+			buf:  valid,
+			n:    len(valid),
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict:     {"a", "bb", "ccc"},
+				DirentsHeuristicBruteforce: {"a", "bb", "ccc"},
+				DirentsHeuristicScan:       {"a", "bb", "ccc"},
+			},
+		},
+		{
+			name: "empty",
+			buf:  valid,
+			n:    0,
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict:     nil,
+				DirentsHeuristicBruteforce: nil,
+				DirentsHeuristicScan:       nil,
+			},
+		},
+		{
+			name: "n beyond the buffer",
+			buf:  valid,
+			n:    len(valid) * 2,
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict:     {"a", "bb", "ccc"},
+				DirentsHeuristicBruteforce: {"a", "bb", "ccc"},
+				DirentsHeuristicScan:       {"a", "bb", "ccc"},
+			},
+		},
+		{
+			name: "truncated in the middle of an entry",
+			buf:  valid,
+			n:    len(valid) - 4,
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict: {"a", "bb"},
+				// the rest of the entry is read beyond n (within the buffer)
+				DirentsHeuristicBruteforce: {"a", "bb", "ccc"},
+				DirentsHeuristicScan:       {"a", "bb"},
+			},
+		},
+		{
+			name: "zero d_reclen",
+			buf:  makeDirents(nil, a, zeroRecLen, c),
+			n:    len(makeDirents(nil, a, zeroRecLen, c)),
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict:     {"a"},
+				DirentsHeuristicBruteforce: {"a", "zzzzz", "ccc"},
+				DirentsHeuristicScan:       {"a", "ccc"},
+			},
+		},
+		{
+			name: "too large d_reclen",
+			buf:  makeDirents(nil, hugeRecLen, b),
+			n:    len(makeDirents(nil, hugeRecLen, b)),
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicStrict:     nil,
+				DirentsHeuristicBruteforce: {"huge"},
+				DirentsHeuristicScan:       {"bb"},
+			},
+		},
+		{
+			name: "garbage before the entries",
+			buf:  makeDirents([]byte{0xff, 0xff, 0xff, 0xff, 0xff}, b, c),
+			n:    len(makeDirents([]byte{0xff, 0xff, 0xff, 0xff, 0xff}, b, c)),
+			expected: map[DirentsHeuristic][]string{
+				DirentsHeuristicScan: {"bb", "ccc"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for heuristic, expected := range tc.expected {
+				entries, err := ParseDirents(tc.buf, tc.n, heuristic)
+				if err != nil {
+					t.Fatalf("%s: %v", heuristic, err)
+				}
+				if names := direntNames(entries); !reflect.DeepEqual(names, expected) {
+					t.Errorf("%s: got %q, expected %q", heuristic, names, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDirentsFields(t *testing.T) {
+	d := testDirent{ino: 1234567890123, off: 987654321, dType: dtSock, name: "socket"}
+	buf := makeDirents(nil, d)
+	entries, err := ParseDirents(buf, len(buf), DirentsHeuristicStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DirEntry{{
+		Name:   "socket",
+		Inode:  d.ino,
+		Type:   DirEntryTypeSocket,
+		RecLen: uint16(len(buf)),
+		Offset: d.off,
+	}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got %+v, expected %+v", entries, expected)
+	}
+}
+
+func TestParseDirentsUnknownHeuristic(t *testing.T) {
+	if _, err := ParseDirents(nil, 0, DirentsHeuristic("unknown")); err == nil {
+		t.Errorf("no error for an unknown heuristic")
+	}
+}
+
+func TestParseDirentsRandom(t *testing.T) {
+	// corrupted buffers should never make the parsers to panic or to hang
+	rng := rand.New(rand.NewSource(1))
+	for iteration := 0; iteration < 1000; iteration++ {
+		buf := make([]byte, rng.Intn(listBufSize))
+		rng.Read(buf)
+		if len(buf) > 0 && rng.Intn(2) == 0 {
+			// small d_reclen values make the parsers to walk the whole buffer
+			for pos := 0; pos+direntStructSize <= len(buf); pos += direntStructSize {
+				hostByteOrder.PutUint16(buf[pos+direntOffsetReclen:], uint16(rng.Intn(3)*direntAlignment))
+			}
+		}
+		n := len(buf)
+		if n > 0 {
+			n = rng.Intn(n + 1)
+		}
+		for _, heuristic := range DirentsHeuristics {
+			if _, err := ParseDirents(buf, n, heuristic); err != nil {
+				t.Fatalf("%s: %v", heuristic, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package osrecovery
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// helperCommand is the hidden subcommand, which makes the binary work as
+// a helper process instead of running its main(). Syscalls which may hang
+// on failing media are executed in such helpers, so that they could be
+// killed (abandoned) by a watchdog without blocking the main process.
+const helperCommand = "__osrecovery-helper"
+
+var helpers = map[string]func(args []string) int{
+	"list":  listHelperMain,
+	"read":  readHelperMain,
+	"lstat": lstatHelperMain,
+}
+
+func init() {
+	if len(os.Args) < 3 || os.Args[1] != helperCommand {
+		return
+	}
+	helper, ok := helpers[os.Args[2]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown helper '%s'\n", os.Args[2])
+		os.Exit(int(syscall.EINVAL))
+	}
+	os.Exit(helper(os.Args[3:]))
+}
+
+// newHelperCmd returns a command which re-executes the current binary as the helper.
+func newHelperCmd(ctx context.Context, helper string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", append([]string{helperCommand, helper}, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// helperProcess is a running helper, which serves gob-encoded requests
+// from its stdin and replies to its stdout.
+type helperProcess struct {
+	ctx     context.Context
+	timeout time.Duration
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	enc     *gob.Encoder
+	dec     *gob.Decoder
+}
+
+func startHelperProcess(ctx context.Context, timeout time.Duration, helper string, args ...string) (*helperProcess, error) {
+	cmd := newHelperCmd(ctx, helper, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stdin of the helper: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stdout of the helper: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start the helper: %w", err)
+	}
+	return &helperProcess{
+		ctx:     ctx,
+		timeout: timeout,
+		cmd:     cmd,
+		stdin:   stdin,
+		enc:     gob.NewEncoder(stdin),
+		dec:     gob.NewDecoder(stdout),
+	}, nil
+}
+
+// Exchange sends the request (if not nil) and waits for the response
+// not longer than the timeout. If an error is returned, then the helper
+// is already killed and should not be used anymore.
+func (p *helperProcess) Exchange(req, resp interface{}) error {
+	doneCh := make(chan error, 1)
+	go func() {
+		if req != nil {
+			if err := p.enc.Encode(req); err != nil {
+				doneCh <- err
+				return
+			}
+		}
+		doneCh <- p.dec.Decode(resp)
+	}()
+
+	var timeoutCh <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			p.Kill()
+			return fmt.Errorf("the helper failed: %w", err)
+		}
+		return nil
+	case <-timeoutCh:
+		p.Kill()
+		return ErrTimeout
+	case <-p.ctx.Done():
+		p.Kill()
+		return p.ctx.Err()
+	}
+}
+
+// Kill kills the helper without waiting for it to exit: a process stuck
+// in the uninterruptible sleep will exit only when the syscall completes.
+func (p *helperProcess) Kill() {
+	p.cmd.Process.Kill()
+	go p.cmd.Wait()
+}
+
+// Stop gracefully finishes the helper (it exits on EOF of stdin).
+func (p *helperProcess) Stop() {
+	p.stdin.Close()
+	go p.cmd.Wait()
+}
+
+// helperError is the serializable form of an error of a syscall made by a helper.
+type helperError struct {
+	Errno   int
+	Message string
+}
+
+func newHelperError(err error) *helperError {
+	if err == nil {
+		return nil
+	}
+	result := &helperError{Message: err.Error()}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		result.Errno = int(errno)
+	}
+	return result
+}
+
+// Err converts the error back, keeping the errno (if any) available via errors.As.
+func (err *helperError) Err(op, path string) error {
+	if err == nil {
+		return nil
+	}
+	if err.Errno != 0 {
+		return &os.PathError{Op: op, Path: path, Err: syscall.Errno(err.Errno)}
+	}
+	return &os.PathError{Op: op, Path: path, Err: fmt.Errorf("%s", err.Message)}
+}
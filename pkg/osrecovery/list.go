@@ -3,8 +3,11 @@ package osrecovery
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,17 +15,137 @@ import (
 )
 
 const (
-	newNameTimeout = time.Hour
+	defaultInactivityTimeout = time.Hour
+	defaultMaxDuplicates     = 10
+	minWatchDogInterval      = 10 * time.Millisecond
 )
 
+var (
+	// ErrTimeout is reported when a helper process did not respond in time.
+	ErrTimeout = errors.New("watchdog timeout")
+
+	// ErrTooManyEntries is reported when a directory listing exceeds ListOptions.MaxEntries.
+	ErrTooManyEntries = errors.New("too many directory entries")
+)
+
+// ListOptions defines when a directory listing is considered broken
+// and is cancelled.
+type ListOptions struct {
+	// InactivityTimeout is the maximal duration without new names,
+	// zero means one hour.
+	InactivityTimeout time.Duration
+
+	// MaxEntries is the maximal amount of entries (including duplicates)
+	// in the directory, zero means no limit.
+	MaxEntries uint64
+
+	// MaxDuplicates is the maximal amount of occurrences of the same
+	// name, zero means 10.
+	MaxDuplicates uint
+
+	// MaxDuration is the maximal wall-clock time of listing the directory,
+	// zero means no limit.
+	MaxDuration time.Duration
+
+	// DumpDir enables saving the raw getdents64 output of every listed
+	// directory into this directory (see ReadDirentsDump).
+	DumpDir string
+}
+
+func (opts ListOptions) inactivityTimeout() time.Duration {
+	if opts.InactivityTimeout <= 0 {
+		return defaultInactivityTimeout
+	}
+	return opts.InactivityTimeout
+}
+
+func (opts ListOptions) maxDuplicates() int {
+	if opts.MaxDuplicates == 0 {
+		return defaultMaxDuplicates
+	}
+	return int(opts.MaxDuplicates)
+}
+
+func (opts ListOptions) watchDogInterval() time.Duration {
+	interval := opts.inactivityTimeout()
+	if opts.MaxDuration > 0 && opts.MaxDuration < interval {
+		interval = opts.MaxDuration
+	}
+	interval /= 50
+	if interval < minWatchDogInterval {
+		interval = minWatchDogInterval
+	}
+	return interval
+}
+
+// ErrDuplicateName is reported when a directory listing returns the same name multiple times.
+type ErrDuplicateName struct {
+	Name  string
+	Count int
+}
+
+func (err ErrDuplicateName) Error() string {
+	return fmt.Sprintf("name '%s' is duplicated (count: %d)", err.Name, err.Count)
+}
+
+// DirEntryType is the type of a directory entry as reported by d_type.
+type DirEntryType uint8
+
+const (
+	DirEntryTypeUnknown = DirEntryType(iota)
+	DirEntryTypeRegular
+	DirEntryTypeDirectory
+	DirEntryTypeFIFO
+	DirEntryTypeSocket
+	DirEntryTypeSymlink
+	DirEntryTypeBlockDevice
+	DirEntryTypeCharDevice
+)
+
+// dirEntryTypeNames are the type names as printed by the lister.
+var dirEntryTypeNames = map[string]DirEntryType{
+	"regular":   DirEntryTypeRegular,
+	"directory": DirEntryTypeDirectory,
+	"FIFO":      DirEntryTypeFIFO,
+	"socket":    DirEntryTypeSocket,
+	"symlink":   DirEntryTypeSymlink,
+	"block dev": DirEntryTypeBlockDevice,
+	"char dev":  DirEntryTypeCharDevice,
+}
+
+func (t DirEntryType) String() string {
+	for name, value := range dirEntryTypeNames {
+		if value == t {
+			return name
+		}
+	}
+	return "???"
+}
+
+// DirEntry is a single entry of a directory listing, as returned by getdents64.
+//
+// The fields are taken from the raw dirent as is, thus on a corrupted
+// filesystem (or after bruteforcing an invalid d_reclen) they may be garbage.
+type DirEntry struct {
+	Name   string
+	Inode  uint64
+	Type   DirEntryType
+	RecLen uint16
+	Offset int64
+}
+
 type listOutputParser struct {
-	NameCh              chan string
+	EntryCh             chan DirEntry
 	ErrCh               chan error
 	CurrentFieldNum     int
 	FieldValue          []byte
+	CurrentEntry        DirEntry
 	lastNewNameTSLocker sync.Mutex
 	lastNewNameTS       time.Time
 	nameCount           map[string]int
+	entryCount          uint64
+	stopped             bool
+	opts                ListOptions
 	logger              logger.Logger
 	cancelFn            context.CancelFunc
 	status              int
@@ -32,10 +155,11 @@ type listOutputParser struct {
 
 var _ io.Writer = (*listOutputParser)(nil)
 
-func newListOutputParser(ctx context.Context) (context.Context, *listOutputParser) {
+func newListOutputParser(ctx context.Context, opts ListOptions) (context.Context, *listOutputParser) {
 	p := &listOutputParser{
 		nameCount:     map[string]int{},
 		lastNewNameTS: time.Now(),
+		opts:          opts,
 	}
 	ctx = p.start(ctx)
 	p.logger = logger.FromCtx(ctx)
@@ -43,7 +167,7 @@ func newListOutputParser(ctx context.Context) (context.Context, *listOutputParse
 }
 
 func (p *listOutputParser) start(ctx context.Context) context.Context {
-	p.NameCh = make(chan string)
+	p.EntryCh = make(chan DirEntry)
 	p.ErrCh = make(chan error)
 	ctx, p.cancelFn = context.WithCancel(ctx)
 	return ctx
@@ -59,7 +183,9 @@ func (p *listOutputParser) StartWatchDog(ctx context.Context) {
 }
 
 func (p *listOutputParser) watchDog(ctx context.Context) {
-	ticker := time.NewTicker(newNameTimeout / 50)
+	startTS := time.Now()
+	inactivityTimeout := p.opts.inactivityTimeout()
+	ticker := time.NewTicker(p.opts.watchDogInterval())
 	defer ticker.Stop()
 	for {
 		select {
@@ -68,19 +194,31 @@ func (p *listOutputParser) watchDog(ctx context.Context) {
 		case <-ticker.C:
 		}
 		ts := p.LastNewNameTS()
-		if time.Since(ts) > newNameTimeout {
-			p.ErrCh <- fmt.Errorf("watchdog timeout")
+		if time.Since(ts) > inactivityTimeout {
+			p.ErrCh <- fmt.Errorf("%w: no new names for %v", ErrTimeout, inactivityTimeout)
+			p.cancelFn()
+			return
+		}
+		if p.opts.MaxDuration > 0 && time.Since(startTS) > p.opts.MaxDuration {
+			p.ErrCh <- fmt.Errorf("%w: the listing takes longer than %v", ErrTimeout, p.opts.MaxDuration)
 			p.cancelFn()
 			return
 		}
 	}
 }
 
+// stop cancels the listing due to the error, the rest of the output is ignored.
+func (p *listOutputParser) stop(err error) {
+	p.ErrCh <- fmt.Errorf("%w, cancelling the dir-scanning", err)
+	p.stopped = true
+	p.cancelFn()
+}
+
 func (p *listOutputParser) Close() {
 	p.wgWatchDog.Wait()
 	p.wgWriteLock.Lock()
 	defer p.wgWriteLock.Unlock()
-	close(p.NameCh)
+	close(p.EntryCh)
 	close(p.ErrCh)
 }
 
@@ -96,17 +234,44 @@ var fieldSeparator = []byte{0}
 func (p *listOutputParser) Write(b []byte) (int, error) {
 	p.wgWriteLock.Lock()
 	defer p.wgWriteLock.Unlock()
+	if p.stopped {
+		return len(b), nil
+	}
 
 	n := 0
 	parseFieldSeparatorType := func() {
 		p.status = 0
 		switch p.CurrentFieldNum {
+		case 0:
+			ino, err := strconv.ParseInt(string(p.FieldValue), 10, 64)
+			if err != nil {
+				p.logger.Warnf("unable to parse inode '%s': %v", p.FieldValue, err)
+			}
+			p.CurrentEntry = DirEntry{Inode: uint64(ino)}
+		case 1:
+			p.CurrentEntry.Type = dirEntryTypeNames[strings.TrimRight(string(p.FieldValue), " ")]
+		case 2:
+			recLen, err := strconv.ParseUint(string(p.FieldValue), 10, 16)
+			if err != nil {
+				p.logger.Warnf("unable to parse reclen '%s': %v", p.FieldValue, err)
+			}
+			p.CurrentEntry.RecLen = uint16(recLen)
+		case 3:
+			offset, err := strconv.ParseInt(string(p.FieldValue), 10, 64)
+			if err != nil {
+				p.logger.Warnf("unable to parse offset '%s': %v", p.FieldValue, err)
+			}
+			p.CurrentEntry.Offset = offset
 		case 4:
 			name := string(p.FieldValue)
+			p.CurrentEntry.Name = name
 			count := p.nameCount[name]
 			count++
 			p.nameCount[name] = count
+			p.entryCount++
 			switch {
+			case p.opts.MaxEntries > 0 && p.entryCount > p.opts.MaxEntries:
+				p.stop(fmt.Errorf("%w (more than %d)", ErrTooManyEntries, p.opts.MaxEntries))
 			case count == 1:
 				func() {
 					p.lastNewNameTSLocker.Lock()
@@ -114,13 +279,12 @@ func (p *listOutputParser) Write(b []byte) (int, error) {
 						p.lastNewNameTS = time.Now()
 						p.lastNewNameTSLocker.Unlock()
 					}()
-					p.NameCh <- name
+					p.EntryCh <- p.CurrentEntry
 				}()
-			case count > 10:
-				p.ErrCh <- fmt.Errorf("name '%s' is duplicated (count: %d), cancelling the dir-scanning", name, count)
-				p.cancelFn()
+			case count > p.opts.maxDuplicates():
+				p.stop(ErrDuplicateName{Name: name, Count: count})
 			default:
-				p.ErrCh <- fmt.Errorf("name '%s' is duplicated (count: %d)", name, count)
+				p.ErrCh <- ErrDuplicateName{Name: name, Count: count}
 			}
 		}
 		switch b[0] {
@@ -141,6 +305,9 @@ func (p *listOutputParser) Write(b []byte) (int, error) {
 	for len(b) > 0 {
 		if p.status == 1 {
 			parseFieldSeparatorType()
+			if p.stopped {
+				return n + len(b), nil
+			}
 		}
 		if len(b) == 0 {
 			break
@@ -0,0 +1,101 @@
+package osrecovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listHelperMain lists the directory using raw getdents64 syscalls, and
+// prints the entries as "<inode>\0\t<type>\0\t<reclen>\0\t<offset>\0\t<name>\0\n".
+// If an entry has an invalid d_reclen, it tries to find the next entry
+// by brute-forcing the offset (see DirentsHeuristicBruteforce).
+//
+// If dump-path is set, then the raw output of getdents64 is also saved
+// there (see ReadDirentsDump).
+//
+// Arguments: [path [dump-path]]
+func listHelperMain(args []string) int {
+	path := "."
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	var dump *direntsDumpWriter
+	if len(args) > 1 {
+		var err error
+		dump, err = newDirentsDumpWriter(args[1], path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to create the dump:", err)
+			return 1
+		}
+		defer dump.Close()
+	}
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open:", err)
+		if dump != nil {
+			dump.WriteError(err)
+		}
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	buf := make([]byte, listBufSize)
+	for {
+		var position int64
+		if dump != nil {
+			position, _ = syscall.Seek(fd, 0, io.SeekCurrent)
+		}
+		nread, err := syscall.Getdents(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			out.Flush()
+			fmt.Fprintln(os.Stderr, "getdents64:", err)
+			if dump != nil {
+				dump.WriteError(err)
+			}
+			return 1
+		}
+		if nread == 0 {
+			break
+		}
+		if dump != nil {
+			if err := dump.WriteBuffer(position, buf[:nread]); err != nil {
+				fmt.Fprintln(os.Stderr, "unable to write the dump:", err)
+				return 1
+			}
+		}
+
+		entries, _ := ParseDirents(buf, nread, DirentsHeuristicBruteforce)
+		for _, entry := range entries {
+			writeDirent(out, entry)
+		}
+		if err := out.Flush(); err != nil {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func writeDirent(out *bufio.Writer, entry DirEntry) {
+	out.WriteString(strconv.FormatInt(int64(entry.Inode), 10))
+	out.WriteString("\x00\t")
+	out.WriteString(fmt.Sprintf("%-10s", entry.Type))
+	out.WriteString("\x00\t")
+	out.WriteString(strconv.FormatUint(uint64(entry.RecLen), 10))
+	out.WriteString("\x00\t")
+	out.WriteString(strconv.FormatInt(entry.Offset, 10))
+	out.WriteString("\x00\t")
+	out.WriteString(entry.Name)
+	out.WriteString("\x00\n")
+}
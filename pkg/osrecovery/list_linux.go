@@ -3,91 +3,41 @@ package osrecovery
 import (
 	"bytes"
 	"context"
-	_ "embed"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"sync"
+	"strings"
 
 	"github.com/facebookincubator/go-belt/beltctx"
 )
 
-var (
-	listHandlerSourcePath   string
-	listHandlerCompiledPath string
-	listHandlerInitOnce     sync.Once
-
-	//go:embed list_linux/main.c
-	listHandlerSource string
-)
-
-func List(ctx context.Context, path string) (<-chan string, <-chan error, error) {
-	lazyInitOpenHandler()
-
-	ctx, listOutputParser := newListOutputParser(beltctx.WithField(ctx, "command", []string{listHandlerCompiledPath, path}))
-	cmd := exec.CommandContext(ctx, listHandlerCompiledPath, path)
+// List lists the directory in a helper process using raw getdents64 syscalls.
+func List(ctx context.Context, path string, opts ListOptions) (<-chan DirEntry, <-chan error, error) {
+	args := []string{path}
+	if opts.DumpDir != "" {
+		args = append(args, DirentsDumpPath(opts.DumpDir, path))
+	}
+	ctx, listOutputParser := newListOutputParser(beltctx.WithField(ctx, "command", append([]string{helperCommand, "list"}, args...)), opts)
+	cmd := newHelperCmd(ctx, "list", args...)
 	cmd.Stdout = listOutputParser
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	err := cmd.Start()
 
 	if err != nil {
 		return nil, nil, fmt.Errorf(
-			"unable to start command '%s %s': %w",
-			listHandlerCompiledPath,
-			path,
+			"unable to start command '%s': %w",
+			strings.Join(cmd.Args, " "),
 			err,
 		)
 	}
 	go func() {
-		cmd.Wait()
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
+			listOutputParser.ErrCh <- fmt.Errorf("the lister failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		// the listing is finished, thus stopping the watchdog
+		listOutputParser.cancelFn()
 		listOutputParser.Close()
 	}()
 	listOutputParser.StartWatchDog(ctx)
-	return listOutputParser.NameCh, listOutputParser.ErrCh, nil
-}
-
-func lazyInitOpenHandler() {
-	listHandlerInitOnce.Do(func() {
-		initOpenHandler()
-	})
-}
-
-func initOpenHandler() {
-	listHandlerDir := filepath.Join(os.TempDir(), "osrecovery-initListHandler")
-	listHandlerSourcePath = filepath.Join(listHandlerDir, "main.c")
-	listHandlerCompiledPath = filepath.Join(listHandlerDir, "compiled")
-	defer func() {
-		log.Println("listHandlerPath:", listHandlerCompiledPath)
-	}()
-	oldSource, err := os.ReadFile(listHandlerSourcePath)
-	if err == nil && bytes.Equal(oldSource, []byte(listHandlerSource)) {
-		fInfo, err := os.Stat(listHandlerCompiledPath)
-		if err == nil && fInfo.Size() > 0 && fInfo.Mode().IsRegular() {
-			return
-		} else {
-			listHandlerDir, err = os.MkdirTemp(os.TempDir(), "osrecovery-initListHandler-")
-			if err != nil {
-				panic(err)
-			}
-
-			listHandlerSourcePath = filepath.Join(listHandlerDir, "main.c")
-			listHandlerCompiledPath = filepath.Join(listHandlerDir, "compiled")
-		}
-	}
-
-	err = os.MkdirAll(listHandlerDir, 0755)
-	if err != nil {
-		panic(err)
-	}
-	err = os.WriteFile(listHandlerSourcePath, []byte(listHandlerSource), 0640)
-	if err != nil {
-		panic(err)
-	}
-
-	cmd := exec.Command("gcc", "-o", listHandlerCompiledPath, listHandlerSourcePath)
-	err = cmd.Run()
-	if err != nil {
-		panic(err)
-	}
+	return listOutputParser.EntryCh, listOutputParser.ErrCh, nil
 }
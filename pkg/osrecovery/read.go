@@ -0,0 +1,129 @@
+package osrecovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DirectIOAlignment is the alignment of offsets and lengths of reads
+// required by O_DIRECT.
+const DirectIOAlignment = 4096
+
+type OpenOptions struct {
+	// Timeout is the maximal duration of a single operation (open or read),
+	// after that the helper process is killed. Zero means no timeout.
+	Timeout time.Duration
+
+	// Direct enables O_DIRECT, thus reads should be aligned
+	// to DirectIOAlignment.
+	Direct bool
+}
+
+type readRequest struct {
+	Offset int64
+	Length int
+}
+
+type readResponse struct {
+	Size  int64
+	Data  []byte
+	EOF   bool
+	Error *helperError
+}
+
+// File is a read-only file, which is read by a helper process. If an operation
+// hangs longer than the timeout, the helper is killed and the operation
+// fails with ErrTimeout; the next operation starts a new helper.
+type File struct {
+	ctx    context.Context
+	path   string
+	opts   OpenOptions
+	size   int64
+	locker sync.Mutex
+	closed bool
+	helper *helperProcess
+}
+
+var _ io.ReaderAt = (*File)(nil)
+
+// Open opens the file for reading in a helper process.
+func Open(ctx context.Context, path string, opts OpenOptions) (*File, error) {
+	f := &File{
+		ctx:  ctx,
+		path: path,
+		opts: opts,
+	}
+	if err := f.start(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) start() error {
+	mode := "buffered"
+	if f.opts.Direct {
+		mode = "direct"
+	}
+	helper, err := startHelperProcess(f.ctx, f.opts.Timeout, "read", mode, f.path)
+	if err != nil {
+		return err
+	}
+
+	var resp readResponse
+	if err := helper.Exchange(nil, &resp); err != nil {
+		return fmt.Errorf("unable to open '%s': %w", f.path, err)
+	}
+	if err := resp.Error.Err("open", f.path); err != nil {
+		helper.Stop()
+		return err
+	}
+	f.helper = helper
+	f.size = resp.Size
+	return nil
+}
+
+// Size returns the size of the file at the moment of opening.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(b []byte, offset int64) (int, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: os.ErrClosed}
+	}
+	if f.helper == nil {
+		if err := f.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	var resp readResponse
+	if err := f.helper.Exchange(&readRequest{Offset: offset, Length: len(b)}, &resp); err != nil {
+		f.helper = nil
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: fmt.Errorf("at offset %d: %w", offset, err)}
+	}
+	n := copy(b, resp.Data)
+	if resp.EOF {
+		return n, io.EOF
+	}
+	return n, resp.Error.Err("read", f.path)
+}
+
+func (f *File) Close() error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.closed = true
+	if f.helper != nil {
+		f.helper.Stop()
+		f.helper = nil
+	}
+	return nil
+}
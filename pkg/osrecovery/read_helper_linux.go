@@ -0,0 +1,104 @@
+package osrecovery
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// readHelperMain serves readRequest-s from stdin, see File.
+//
+// Arguments: <buffered|direct> <path>
+func readHelperMain(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "expected arguments: <buffered|direct> <path>")
+		return int(syscall.EINVAL)
+	}
+	direct := args[0] == "direct"
+	path := args[1]
+
+	enc := gob.NewEncoder(os.Stdout)
+	dec := gob.NewDecoder(os.Stdin)
+
+	flags := os.O_RDONLY
+	if direct {
+		flags |= syscall.O_DIRECT
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		enc.Encode(readResponse{Error: newHelperError(err)})
+		return 1
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		enc.Encode(readResponse{Error: newHelperError(err)})
+		return 1
+	}
+	if err := enc.Encode(readResponse{Size: fi.Size()}); err != nil {
+		return 1
+	}
+
+	var buf []byte
+	for {
+		var req readRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, "unable to decode a request:", err)
+			return 1
+		}
+
+		if cap(buf) < req.Length {
+			buf = alignedBuffer(req.Length)
+		}
+		n, err := readFull(int(f.Fd()), buf[:req.Length], req.Offset, direct)
+		resp := readResponse{Data: buf[:n]}
+		switch {
+		case err == io.EOF:
+			resp.EOF = true
+		case err != nil:
+			resp.Error = newHelperError(err)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return 1
+		}
+	}
+}
+
+// readFull reads until the buffer is full, EOF or an error. With O_DIRECT
+// only a single pread() is made, because after a short read the offset
+// is not aligned anymore.
+func readFull(fd int, buf []byte, offset int64, direct bool) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := syscall.Pread(fd, buf[total:], offset+int64(total))
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		total += n
+		if direct && total < len(buf) {
+			return total, io.EOF
+		}
+	}
+	return total, nil
+}
+
+// alignedBuffer returns a buffer with the address aligned as required by O_DIRECT.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+DirectIOAlignment)
+	shift := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buf[0])) % DirectIOAlignment); remainder != 0 {
+		shift = DirectIOAlignment - remainder
+	}
+	return buf[shift : shift+size]
+}
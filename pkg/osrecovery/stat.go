@@ -0,0 +1,135 @@
+package osrecovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type StatOptions struct {
+	// Timeout is the maximal duration of a single lstat(), after that
+	// the helper process is killed. Zero means no timeout.
+	Timeout time.Duration
+}
+
+type statResponse struct {
+	Stat  syscall.Stat_t
+	Error *helperError
+}
+
+// Stater makes lstat() calls in a helper process. If a call hangs longer
+// than the timeout, the helper is killed and the call fails with ErrTimeout;
+// the next call starts a new helper.
+type Stater struct {
+	ctx    context.Context
+	opts   StatOptions
+	locker sync.Mutex
+	helper *helperProcess
+}
+
+func NewStater(ctx context.Context, opts StatOptions) *Stater {
+	return &Stater{
+		ctx:  ctx,
+		opts: opts,
+	}
+}
+
+// Lstat is an analog of os.Lstat. FileInfo.Sys() returns *syscall.Stat_t.
+func (s *Stater) Lstat(path string) (os.FileInfo, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.helper == nil {
+		var err error
+		s.helper, err = startHelperProcess(s.ctx, s.opts.Timeout, "lstat")
+		if err != nil {
+			return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+		}
+	}
+
+	var resp statResponse
+	if err := s.helper.Exchange(path, &resp); err != nil {
+		s.helper = nil
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if err := resp.Error.Err("lstat", path); err != nil {
+		return nil, err
+	}
+	return newFileInfo(filepath.Base(path), resp.Stat), nil
+}
+
+func (s *Stater) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.helper != nil {
+		s.helper.Stop()
+		s.helper = nil
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	stat syscall.Stat_t
+}
+
+var _ os.FileInfo = (*fileInfo)(nil)
+
+func newFileInfo(name string, stat syscall.Stat_t) *fileInfo {
+	return &fileInfo{
+		name: name,
+		stat: stat,
+	}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.stat.Size
+}
+
+// Mode converts the mode the same way as os.Lstat does.
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.stat.Mode & 0777)
+	switch fi.stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.stat.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.stat.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.stat.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.stat.Mtim.Sec), int64(fi.stat.Mtim.Nsec))
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return &fi.stat
+}
@@ -0,0 +1,31 @@
+package osrecovery
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lstatHelperMain serves paths from stdin with statResponse-s, see Stater.
+func lstatHelperMain(args []string) int {
+	enc := gob.NewEncoder(os.Stdout)
+	dec := gob.NewDecoder(os.Stdin)
+	for {
+		var path string
+		if err := dec.Decode(&path); err != nil {
+			if err == io.EOF {
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, "unable to decode a request:", err)
+			return 1
+		}
+
+		var resp statResponse
+		resp.Error = newHelperError(syscall.Lstat(path, &resp.Stat))
+		if err := enc.Encode(resp); err != nil {
+			return 1
+		}
+	}
+}
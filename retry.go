@@ -0,0 +1,250 @@
+package slowsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
+)
+
+// RetryStrategy defines how carefully to read a broken file.
+type RetryStrategy struct {
+	// BlockSize is the size of a single read.
+	BlockSize int64
+
+	// Direct enables O_DIRECT, to bypass the page cache (and its readahead).
+	Direct bool
+
+	// Timeout is the maximal duration of a single read.
+	Timeout time.Duration
+
+	// Delay is the cooling-off pause before trying this strategy.
+	Delay time.Duration
+}
+
+func (s RetryStrategy) String() string {
+	return fmt.Sprintf("block size: %d, direct: %v, timeout: %v", s.BlockSize, s.Direct, s.Timeout)
+}
+
+// DefaultRetryStrategies returns progressively more careful strategies:
+// smaller blocks, O_DIRECT, longer timeouts and longer pauses.
+func DefaultRetryStrategies(readTimeout, coolDown time.Duration) []RetryStrategy {
+	return []RetryStrategy{
+		{BlockSize: copyBufferSize, Timeout: readTimeout},
+		{BlockSize: 64 * 1024, Timeout: readTimeout * 2, Delay: coolDown},
+		{BlockSize: 4096, Direct: true, Timeout: readTimeout * 4, Delay: coolDown * 2},
+		{BlockSize: 4096, Direct: true, Timeout: readTimeout * 8, Delay: coolDown * 4},
+	}
+}
+
+type RetryOptions struct {
+	DryRun     bool
+	Strategies []RetryStrategy
+
+	// FsyncDirs is the same as SyncOptions.FsyncDirs.
+	FsyncDirs bool
+
+	// Metadata is the same as SyncOptions.Metadata.
+	Metadata MetadataOptions
+
+	// SalvageMap is the path to the salvage map (see SetSalvageMap); if set,
+	// then the recovered files are removed from it.
+	SalvageMap string
+}
+
+// RetryBrokenFiles walks only the files from the broken-files list of
+// the source and tries to copy them to dstDir using the strategies one
+// by one. The recovered files are removed from the list (and from the salvage
+// map, if set), the attempt counters of the rest are bumped.
+func RetryBrokenFiles(srcDir, dstDir, brokenFilesListPath string, opts RetryOptions) error {
+	srcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return err
+	}
+	dstDir, err = filepath.Abs(dstDir)
+	if err != nil {
+		return err
+	}
+	if len(opts.Strategies) == 0 {
+		return fmt.Errorf("no retry strategies are defined")
+	}
+
+	brokenFiles := newBrokenFilesList()
+	if err := brokenFiles.Open(brokenFilesListPath); err != nil {
+		return err
+	}
+	defer brokenFiles.Close()
+
+	var salvageMap *salvageMap
+	if opts.SalvageMap != "" {
+		salvageMap, err = openSalvageMap(opts.SalvageMap)
+		if err != nil {
+			return err
+		}
+		defer salvageMap.Close()
+	}
+
+	pending := map[string]error{}
+	for _, entry := range brokenFiles.Entries() {
+		filePath, ok := relativeToRoot(srcDir, entry.Path)
+		if !ok {
+			log.Printf("Retrying: '%s' is not inside '%s', skipping", entry.Path, srcDir)
+			continue
+		}
+		fileInfo, err := os.Lstat(filepath.Join(srcDir, filePath))
+		if err == nil && !fileInfo.Mode().IsRegular() {
+			log.Printf("Retrying: '%s' is not a regular file, skipping", entry.Path)
+			continue
+		}
+		pending[entry.Path] = err
+	}
+
+	fmt.Println("Retrying: to retry report")
+	for _, entryPath := range sortedKeys(pending) {
+		fmt.Println(entryPath)
+	}
+	fmt.Println("Retrying: to retry report -- complete")
+	if opts.DryRun {
+		return nil
+	}
+
+	var recovered []string
+	for idx, strategy := range opts.Strategies {
+		if len(pending) == 0 {
+			break
+		}
+		if idx > 0 && strategy.Delay > 0 {
+			log.Printf("Retrying: cooling off for %v", strategy.Delay)
+			time.Sleep(strategy.Delay)
+		}
+		log.Printf("Retrying: %d files with strategy #%d (%s)", len(pending), idx, strategy)
+
+		for _, entryPath := range sortedKeys(pending) {
+			filePath, _ := relativeToRoot(srcDir, entryPath)
+			srcPath, dstPath := filepath.Join(srcDir, filePath), filepath.Join(dstDir, filePath)
+			// before reading the file, to get the original atime
+			commit, err := newCommitOptions(srcPath, opts.Metadata, opts.FsyncDirs)
+			if err != nil {
+				err = withPhase(BrokenFilePhaseLstat, err)
+			} else if err = createDirectory(filepath.Dir(dstPath)); err != nil {
+				err = withPhase(BrokenFilePhaseWrite, err)
+			} else {
+				err = retryCopyFileContents(srcPath, dstPath, strategy, commit)
+			}
+			if err == nil && salvageMap != nil {
+				// the whole file is rewritten, nothing is missing anymore
+				if err := salvageMap.Remove(filePath); err != nil {
+					log.Printf("Retrying: unable to update the salvage map: %v", err)
+				}
+			}
+			if err == nil {
+				fmt.Println("recovered file:", entryPath)
+				recovered = append(recovered, entryPath)
+				delete(pending, entryPath)
+				continue
+			}
+			if errorPhase(err) == BrokenFilePhaseWrite {
+				if isFatalDestinationError(err) {
+					return fmt.Errorf("unable to write to the destination: %w", err)
+				}
+				log.Printf("Retrying: unable to write '%s': %v", dstPath, err)
+			}
+			pending[entryPath] = err
+		}
+	}
+
+	if err := brokenFiles.Remove(recovered...); err != nil {
+		return err
+	}
+	for _, entryPath := range sortedKeys(pending) {
+		if _, err := brokenFiles.Add(entryPath, pending[entryPath]); err != nil {
+			return err
+		}
+	}
+	log.Printf("Retrying: recovered %d files, still broken %d files", len(recovered), len(pending))
+	return nil
+}
+
+func sortedKeys(m map[string]error) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// relativeToRoot converts a path from the broken-files list (which may be
+// absolute or relative to the root) to a path relative to the root.
+func relativeToRoot(rootPath, entryPath string) (string, bool) {
+	if !filepath.IsAbs(entryPath) {
+		return filepath.Clean(entryPath), true
+	}
+	rel, err := filepath.Rel(rootPath, entryPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+func retryCopyFileContents(src, dst string, strategy RetryStrategy, commit commitOptions) (err error) {
+	blockSize := strategy.BlockSize
+	if blockSize <= 0 {
+		blockSize = copyBufferSize
+	}
+	if strategy.Direct {
+		if remainder := blockSize % osrecovery.DirectIOAlignment; remainder != 0 {
+			blockSize += osrecovery.DirectIOAlignment - remainder
+		}
+	}
+	buf := make([]byte, blockSize)
+
+	// a read stuck in the uninterruptible sleep is abandoned together with
+	// the helper process, instead of wedging a thread of this process
+	in, err := osrecovery.Open(context.Background(), src, osrecovery.OpenOptions{
+		Timeout: strategy.Timeout,
+		Direct:  strategy.Direct,
+	})
+	if err != nil {
+		return withPhase(BrokenFilePhaseOpen, err)
+	}
+	defer in.Close()
+
+	out, err := createAtomicFile(dst)
+	if err != nil {
+		return withPhase(BrokenFilePhaseWrite, err)
+	}
+	defer func() {
+		if err != nil {
+			out.Abort()
+			return
+		}
+		if commitErr := out.Commit(commit); commitErr != nil {
+			err = withPhase(BrokenFilePhaseWrite, commitErr)
+		}
+	}()
+
+	for offset := int64(0); ; {
+		// with O_DIRECT a short read is reported as EOF (see osrecovery.File)
+		n, err := in.ReadAt(buf, offset)
+		if n > 0 {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				return withPhase(BrokenFilePhaseWrite, err)
+			}
+			offset += int64(n)
+		}
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return withPhase(BrokenFilePhaseRead, err)
+		}
+	}
+}
@@ -40,13 +40,13 @@ func SetRLimits(
 	}
 }
 
-func GetFileTreeWrapper(dir, cachePath, brokenFilesList string, maxDepth uint, maxOpenFiles uint64) (FileTree, error) {
+func GetFileTreeWrapper(dir, cachePath, brokenFilesList string, maxDepth uint, maxOpenFiles uint64, opts ScanOptions) (FileTree, error) {
 	var fileTree FileTree
 	var err error
 	if cachePath == "" {
-		fileTree, err = GetFileTree(dir, maxDepth, maxOpenFiles)
+		fileTree, err = GetFileTree(dir, maxDepth, maxOpenFiles, opts)
 	} else {
-		fileTree, err = GetCachedFileTree(dir, cachePath, maxDepth, maxOpenFiles)
+		fileTree, err = GetCachedFileTree(dir, cachePath, maxDepth, maxOpenFiles, opts)
 	}
 	if err != nil {
 		return nil, err
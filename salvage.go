@@ -0,0 +1,284 @@
+package slowsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/xaionaro-go/errors"
+)
+
+const (
+	copyBufferSize          = 1024 * 1024
+	defaultSalvageBlockSize = copyBufferSize
+	defaultSalvageMinBlock  = 512
+)
+
+// SalvageOptions configures the ddrescue-style copying, where unreadable
+// parts of a file are skipped instead of failing the whole file.
+type SalvageOptions struct {
+	Enabled bool
+
+	// BlockSize is the size of a read on the first pass (default: 1MiB).
+	BlockSize int64
+
+	// MinBlockSize is the size of a block, which is not split anymore
+	// if it fails to be read (default: 512 bytes).
+	MinBlockSize int64
+
+	// Retries is how many extra times to try to read a block of MinBlockSize
+	// before considering it bad.
+	Retries uint
+
+	// LeaveHoles makes unreadable ranges to be skipped in the destination
+	// file (so they become holes) instead of filling them with zeros.
+	LeaveHoles bool
+}
+
+func (opts SalvageOptions) blockSize() int64 {
+	if opts.BlockSize <= 0 {
+		return defaultSalvageBlockSize
+	}
+	return opts.BlockSize
+}
+
+func (opts SalvageOptions) minBlockSize() int64 {
+	if opts.MinBlockSize <= 0 {
+		return defaultSalvageMinBlock
+	}
+	if opts.MinBlockSize > opts.blockSize() {
+		return opts.blockSize()
+	}
+	return opts.MinBlockSize
+}
+
+// ByteRange is a range of bytes of a file: [Offset, Offset+Length).
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+func (r ByteRange) End() int64 {
+	return r.Offset + r.Length
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("[%d, %d)", r.Offset, r.End())
+}
+
+type ByteRanges []ByteRange
+
+func (s ByteRanges) String() string {
+	var parts []string
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// TotalLength returns the sum of lengths of the ranges.
+func (s ByteRanges) TotalLength() int64 {
+	var result int64
+	for _, r := range s {
+		result += r.Length
+	}
+	return result
+}
+
+// add appends the range, merging it with the last one if they are adjacent.
+func (s ByteRanges) add(r ByteRange) ByteRanges {
+	if len(s) > 0 && s[len(s)-1].End() == r.Offset {
+		s[len(s)-1].Length += r.Length
+		return s
+	}
+	return append(s, r)
+}
+
+// ErrBadRanges is returned for a salvaged file which has unreadable ranges.
+type ErrBadRanges struct {
+	Ranges ByteRanges
+}
+
+func (err ErrBadRanges) Error() string {
+	return fmt.Sprintf("unable to read %d bytes: %s", err.Ranges.TotalLength(), err.Ranges)
+}
+
+type salvager struct {
+	in        io.ReaderAt
+	out       io.WriterAt
+	size      int64 // the size of the source file
+	opts      SalvageOptions
+	buf       []byte
+	zeros     []byte
+	badRanges ByteRanges
+}
+
+// salvageFileContents copies the file block by block, splitting failed blocks
+// into smaller ones down to opts.MinBlockSize. The ranges which could not be
+// read are returned as ErrBadRanges.
+//
+// If resumeRanges is not nil, then only these ranges are copied into
+// the existing destination file (in place), otherwise the file is written
+// atomically (see atomicFile). The size of the source file is returned.
+func (ft *fileTree) salvageFileContents(src, dst string, resumeRanges ByteRanges, opts SalvageOptions, commit commitOptions) (size int64, err error) {
+	in, err := ft.openSourceFile(src)
+	if err != nil {
+		return 0, withPhase(BrokenFilePhaseOpen, errors.New(err))
+	}
+	defer in.Close()
+	size = in.Size()
+
+	var out *os.File
+	var atomicOut *atomicFile
+	if resumeRanges == nil {
+		atomicOut, err = createAtomicFile(dst)
+		if err == nil {
+			out = atomicOut.File
+		}
+		resumeRanges = ByteRanges{{Length: size}}
+	} else {
+		out, err = os.OpenFile(dst, os.O_WRONLY, 0)
+	}
+	if err != nil {
+		return size, withPhase(BrokenFilePhaseWrite, errors.New(err))
+	}
+	defer func() {
+		// a file with bad ranges is still the best copy there is
+		_, isBadRanges := err.(ErrBadRanges)
+		if atomicOut == nil {
+			var closeErr error
+			if commit.prepare != nil && (err == nil || isBadRanges) {
+				closeErr = commit.prepare(dst)
+			}
+			if closeErr == nil {
+				closeErr = out.Sync()
+			}
+			if closeErr == nil {
+				closeErr = out.Close()
+			} else {
+				out.Close()
+			}
+			if err == nil || (isBadRanges && closeErr != nil) {
+				err = withPhase(BrokenFilePhaseWrite, closeErr)
+			}
+			return
+		}
+		if err != nil && !isBadRanges {
+			atomicOut.Abort()
+			return
+		}
+		if commitErr := atomicOut.Commit(commit); commitErr != nil {
+			err = withPhase(BrokenFilePhaseWrite, errors.New(commitErr))
+		}
+	}()
+
+	s := &salvager{
+		in:   in,
+		out:  out,
+		size: size,
+		opts: opts,
+		buf:  make([]byte, opts.blockSize()),
+	}
+	if !opts.LeaveHoles {
+		s.zeros = make([]byte, opts.minBlockSize())
+	}
+
+	blockSize := opts.blockSize()
+	for _, r := range resumeRanges {
+		if r.End() > size {
+			r.Length = size - r.Offset
+		}
+		if err := s.copySplitBlock(r.Offset, r.Length, blockSize); err != nil {
+			return size, err
+		}
+	}
+
+	// the tail could be a hole, so the size is not set by writes
+	if err := out.Truncate(size); err != nil {
+		return size, withPhase(BrokenFilePhaseWrite, errors.New(err))
+	}
+
+	if len(s.badRanges) > 0 {
+		return size, ErrBadRanges{Ranges: s.badRanges}
+	}
+	return size, nil
+}
+
+func (s *salvager) copyBlock(offset, length, blockSize int64) error {
+	for length > 0 {
+		n, err := s.in.ReadAt(s.buf[:length], offset)
+		if n > 0 {
+			if _, err := s.out.WriteAt(s.buf[:n], offset); err != nil {
+				return withPhase(BrokenFilePhaseWrite, errors.New(err))
+			}
+			offset += int64(n)
+			length -= int64(n)
+		}
+		if length == 0 || s.isEOF(offset, err) {
+			return nil
+		}
+		if n > 0 {
+			// the read was partially successful, reading the rest of the block
+			continue
+		}
+
+		if blockSize > s.opts.minBlockSize() {
+			return s.copySplitBlock(offset, length, blockSize/2)
+		}
+
+		recovered, err := s.retry(offset, length)
+		if err != nil {
+			return err
+		}
+		if recovered {
+			return nil
+		}
+
+		s.badRanges = s.badRanges.add(ByteRange{Offset: offset, Length: length})
+		if s.zeros != nil {
+			if _, err := s.out.WriteAt(s.zeros[:length], offset); err != nil {
+				return withPhase(BrokenFilePhaseWrite, errors.New(err))
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func (s *salvager) copySplitBlock(offset, length, blockSize int64) error {
+	if blockSize < s.opts.minBlockSize() {
+		blockSize = s.opts.minBlockSize()
+	}
+	end := offset + length
+	for ; offset < end; offset += blockSize {
+		subLength := blockSize
+		if offset+subLength > end {
+			subLength = end - offset
+		}
+		if err := s.copyBlock(offset, subLength, blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEOF returns true if the read ended at the end of the file. A premature
+// EOF (before the size of the file) is a failed read.
+func (s *salvager) isEOF(offset int64, err error) bool {
+	return err == io.EOF && offset >= s.size
+}
+
+func (s *salvager) retry(offset, length int64) (bool, error) {
+	for attempt := uint(0); attempt < s.opts.Retries; attempt++ {
+		n, err := s.in.ReadAt(s.buf[:length], offset)
+		if int64(n) != length && !s.isEOF(offset+int64(n), err) {
+			continue
+		}
+		if _, err := s.out.WriteAt(s.buf[:n], offset); err != nil {
+			return false, withPhase(BrokenFilePhaseWrite, errors.New(err))
+		}
+		return true, nil
+	}
+	return false, nil
+}
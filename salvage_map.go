@@ -0,0 +1,301 @@
+package slowsync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	rangeStatusRecovered = "+"
+	rangeStatusMissing   = "-"
+)
+
+// salvageMap persists which byte ranges of salvaged files were recovered
+// and which are still missing, so that a later run could re-attempt only
+// the missing ones (similar to a ddrescue mapfile, but for many files).
+type salvageMap struct {
+	db             *sql.DB
+	locker         sync.Mutex
+	hasMissingPath map[string]bool
+}
+
+type salvageMapRange struct {
+	ByteRange
+	Status   string
+	Attempts uint
+}
+
+func openSalvageMap(mapPath string) (*salvageMap, error) {
+	db, err := sql.Open("sqlite3", "file:"+mapPath+"?cache=shared")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open '%s': %w", mapPath, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS salvage_map (path varchar(4096), offset bigint, length bigint, status char(1), attempts int)`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create table 'salvage_map' in '%s': %w", mapPath, err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS salvage_map_path_idx ON salvage_map (path)`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create an index in '%s': %w", mapPath, err)
+	}
+
+	m := &salvageMap{
+		db:             db,
+		hasMissingPath: map[string]bool{},
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT path FROM salvage_map WHERE status = ?`, rangeStatusMissing)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read '%s': %w", mapPath, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			return nil, fmt.Errorf("unable to read '%s': %w", mapPath, err)
+		}
+		m.hasMissingPath[filePath] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read '%s': %w", mapPath, err)
+	}
+
+	return m, nil
+}
+
+func (m *salvageMap) Close() error {
+	return m.db.Close()
+}
+
+// HasMissing returns true if the file has ranges, which are still not recovered.
+func (m *salvageMap) HasMissing(filePath string) bool {
+	if m == nil {
+		return false
+	}
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	return m.hasMissingPath[filePath]
+}
+
+func (m *salvageMap) ranges(filePath string) ([]salvageMapRange, error) {
+	rows, err := m.db.Query(`SELECT offset, length, status, attempts FROM salvage_map WHERE path = ? ORDER BY offset`, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []salvageMapRange
+	for rows.Next() {
+		var r salvageMapRange
+		if err := rows.Scan(&r.Offset, &r.Length, &r.Status, &r.Attempts); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// MissingRanges returns the ranges of the file, which are still not recovered.
+func (m *salvageMap) MissingRanges(filePath string) (ByteRanges, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	ranges, err := m.ranges(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ranges of '%s': %w", filePath, err)
+	}
+
+	var result ByteRanges
+	for _, r := range ranges {
+		if r.Status == rangeStatusMissing {
+			result = result.add(r.ByteRange)
+		}
+	}
+	return result, nil
+}
+
+// Update records the result of an attempt to copy ranges "attempted" of
+// the file, where "bad" are the ranges which failed to be read.
+//
+// If "attempted" is nil, then it is considered that the whole file
+// was attempted, and the previous records are discarded.
+func (m *salvageMap) Update(filePath string, size int64, attempted, bad ByteRanges) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	var oldRanges []salvageMapRange
+	if attempted != nil {
+		var err error
+		oldRanges, err = m.ranges(filePath)
+		if err != nil {
+			return fmt.Errorf("unable to get ranges of '%s': %w", filePath, err)
+		}
+	} else {
+		if len(bad) == 0 && !m.hasMissingPath[filePath] {
+			// nothing to remember about a file copied without problems
+			return nil
+		}
+		oldRanges = []salvageMapRange{{
+			ByteRange: ByteRange{Length: size},
+			Status:    rangeStatusMissing,
+		}}
+	}
+
+	var newRanges []salvageMapRange
+	hasMissing := false
+	for _, old := range oldRanges {
+		if old.Status != rangeStatusMissing {
+			newRanges = append(newRanges, old)
+			continue
+		}
+		for _, part := range old.ByteRange.split(bad) {
+			part.Attempts = old.Attempts + 1
+			if part.Status == rangeStatusMissing {
+				hasMissing = true
+			}
+			newRanges = append(newRanges, part)
+		}
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM salvage_map WHERE path = ?`, filePath); err != nil {
+		return fmt.Errorf("unable to delete old ranges of '%s': %w", filePath, err)
+	}
+	for _, r := range newRanges {
+		_, err := tx.Exec(
+			`INSERT INTO salvage_map (path, offset, length, status, attempts) VALUES (?, ?, ?, ?, ?)`,
+			filePath, r.Offset, r.Length, r.Status, r.Attempts,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to insert a range of '%s': %w", filePath, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit the transaction: %w", err)
+	}
+
+	if hasMissing {
+		m.hasMissingPath[filePath] = true
+	} else {
+		delete(m.hasMissingPath, filePath)
+	}
+	return nil
+}
+
+// Remove forgets the file, when it is recovered completely in another way.
+func (m *salvageMap) Remove(filePath string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if _, err := m.db.Exec(`DELETE FROM salvage_map WHERE path = ?`, filePath); err != nil {
+		return fmt.Errorf("unable to delete ranges of '%s': %w", filePath, err)
+	}
+	delete(m.hasMissingPath, filePath)
+	return nil
+}
+
+// split splits the range into parts which intersect with "bad" (marked
+// as missing) and parts which do not (marked as recovered). "bad" is expected
+// to be sorted.
+func (r ByteRange) split(bad ByteRanges) []salvageMapRange {
+	var result []salvageMapRange
+	cur := r.Offset
+	for _, b := range bad {
+		start, end := b.Offset, b.End()
+		if start < cur {
+			start = cur
+		}
+		if end > r.End() {
+			end = r.End()
+		}
+		if start >= end {
+			continue
+		}
+		if start > cur {
+			result = append(result, salvageMapRange{
+				ByteRange: ByteRange{Offset: cur, Length: start - cur},
+				Status:    rangeStatusRecovered,
+			})
+		}
+		result = append(result, salvageMapRange{
+			ByteRange: ByteRange{Offset: start, Length: end - start},
+			Status:    rangeStatusMissing,
+		})
+		cur = end
+	}
+	if cur < r.End() {
+		result = append(result, salvageMapRange{
+			ByteRange: ByteRange{Offset: cur, Length: r.End() - cur},
+			Status:    rangeStatusRecovered,
+		})
+	}
+	return result
+}
+
+func (ft *fileTree) SetSalvageMap(mapPath string) error {
+	if ft.salvageMap != nil {
+		ft.salvageMap.Close()
+	}
+
+	var err error
+	ft.salvageMap, err = openSalvageMap(mapPath)
+	return err
+}
+
+// salvageFile copies the file in the salvage mode. If there is a record
+// in the salvage map about the file, then only the missing ranges are copied.
+// A file with unreadable ranges is written, but ErrBadRanges is returned.
+func (ft *fileTree) salvageFile(filePath, srcPath, dstPath string, opts SalvageOptions, commit commitOptions) error {
+	var resumeRanges ByteRanges
+	if ft.salvageMap.HasMissing(filePath) {
+		var err error
+		resumeRanges, err = ft.salvageMap.MissingRanges(filePath)
+		if err != nil {
+			return err
+		}
+		srcInfo, srcErr := os.Stat(srcPath)
+		dstInfo, dstErr := os.Stat(dstPath)
+		if srcErr != nil || dstErr != nil || srcInfo.Size() != dstInfo.Size() {
+			// the destination file does not correspond to the map, starting from scratch
+			resumeRanges = nil
+		}
+	}
+
+	size, err := ft.salvageFileContents(srcPath, dstPath, resumeRanges, opts, commit)
+	if ft.salvageMap == nil {
+		return err
+	}
+
+	var badRanges ErrBadRanges
+	if err != nil && !errors.As(err, &badRanges) {
+		return err
+	}
+
+	if updateErr := ft.salvageMap.Update(filePath, size, resumeRanges, badRanges.Ranges); updateErr != nil {
+		return fmt.Errorf("unable to update the salvage map: %w", updateErr)
+	}
+	if err != nil {
+		// the file is still reported as failed (and kept in the broken-files
+		// list), while the next run re-attempts only the missing ranges
+		fmt.Println("salvaged file:", filePath, err)
+		return err
+	}
+	if resumeRanges != nil && ft.brokenFiles.Has(filePath) {
+		// the last missing ranges are recovered
+		if err := ft.brokenFiles.Remove(filePath); err != nil {
+			log.Printf("unable to remove '%s' from the broken-files list: %v", filePath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package slowsync
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// testReaderAt is a file with unreadable ranges.
+type testReaderAt struct {
+	data    []byte
+	bad     ByteRanges
+	flaky   map[int64]int // the amount of failed reads from the offset before a successful one
+	maxRead int           // the maximal length of a read (zero means no limit)
+}
+
+func (r *testReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if r.flaky[offset] > 0 {
+		r.flaky[offset]--
+		return 0, syscall.EIO
+	}
+	if offset >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if r.maxRead > 0 && n > int64(r.maxRead) {
+		n = int64(r.maxRead)
+	}
+	if offset+n > int64(len(r.data)) {
+		n = int64(len(r.data)) - offset
+	}
+	for _, bad := range r.bad {
+		if bad.Offset <= offset && offset < bad.End() {
+			return 0, syscall.EIO
+		}
+		if offset < bad.Offset && bad.Offset < offset+n {
+			// the readable part before the bad range
+			n = bad.Offset - offset
+		}
+	}
+	copy(p, r.data[offset:offset+n])
+	if offset+n == int64(len(r.data)) && n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// testWriterAt is the destination file, initially filled with 0xff
+// to tell the holes from the written zeros.
+type testWriterAt struct {
+	data []byte
+}
+
+func (w *testWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	for int64(len(w.data)) < offset+int64(len(p)) {
+		w.data = append(w.data, 0xff)
+	}
+	copy(w.data[offset:], p)
+	return len(p), nil
+}
+
+func TestSalvagerCopy(t *testing.T) {
+	data := make([]byte, 40)
+	for idx := range data {
+		data[idx] = byte(idx + 1)
+	}
+	opts := SalvageOptions{
+		Enabled:      true,
+		BlockSize:    16,
+		MinBlockSize: 4,
+	}
+	withRetries := opts
+	withRetries.Retries = 2
+	withHoles := opts
+	withHoles.LeaveHoles = true
+
+	for _, tc := range []struct {
+		name        string
+		size        int64 // the size of the file as reported by stat (zero means len(data))
+		bad         ByteRanges
+		flaky       map[int64]int
+		maxRead     int
+		opts        SalvageOptions
+		expectedBad ByteRanges
+	}{
+		{
+			name: "no errors",
+			opts: opts,
+		},
+		{
+			name:        "a block is split down to the minimal one",
+			bad:         ByteRanges{{Offset: 20, Length: 2}},
+			opts:        opts,
+			expectedBad: ByteRanges{{Offset: 20, Length: 4}},
+		},
+		{
+			name:        "adjacent bad blocks are merged",
+			bad:         ByteRanges{{Offset: 3, Length: 10}},
+			opts:        opts,
+			expectedBad: ByteRanges{{Offset: 3, Length: 12}},
+		},
+		{
+			name:        "bad tail",
+			bad:         ByteRanges{{Offset: 38, Length: 2}},
+			opts:        opts,
+			expectedBad: ByteRanges{{Offset: 38, Length: 2}},
+		},
+		{
+			name:    "short reads",
+			maxRead: 3,
+			opts:    opts,
+		},
+		{
+			name:    "short reads before a bad block",
+			bad:     ByteRanges{{Offset: 9, Length: 1}},
+			maxRead: 3,
+			opts:    opts,
+			// the block is split starting from the failed read, after the short ones
+			expectedBad: ByteRanges{{Offset: 9, Length: 4}},
+		},
+		{
+			name:        "EOF before the end of the file",
+			size:        48,
+			opts:        opts,
+			expectedBad: ByteRanges{{Offset: 40, Length: 8}},
+		},
+		{
+			name: "EOF at the end of the file",
+			size: 40,
+			opts: opts,
+		},
+		{
+			name: "a retry succeeds",
+			// the first block, its half and its quarter fail, then a retry fails too
+			flaky: map[int64]int{16: 4},
+			opts:  withRetries,
+		},
+		{
+			name:        "retries fail",
+			flaky:       map[int64]int{16: 5},
+			opts:        withRetries,
+			expectedBad: ByteRanges{{Offset: 16, Length: 4}},
+		},
+		{
+			name:        "holes",
+			bad:         ByteRanges{{Offset: 20, Length: 2}},
+			opts:        withHoles,
+			expectedBad: ByteRanges{{Offset: 20, Length: 4}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			size := tc.size
+			if size == 0 {
+				size = int64(len(data))
+			}
+			out := &testWriterAt{}
+			s := &salvager{
+				in: &testReaderAt{
+					data:    data,
+					bad:     tc.bad,
+					flaky:   tc.flaky,
+					maxRead: tc.maxRead,
+				},
+				out:  out,
+				size: size,
+				opts: tc.opts,
+				buf:  make([]byte, tc.opts.blockSize()),
+			}
+			if !tc.opts.LeaveHoles {
+				s.zeros = make([]byte, tc.opts.minBlockSize())
+			}
+			if err := s.copySplitBlock(0, size, tc.opts.blockSize()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s.badRanges, tc.expectedBad) {
+				t.Errorf("got bad ranges %v, expected %v", s.badRanges, tc.expectedBad)
+			}
+
+			expected := make([]byte, size)
+			copy(expected, data)
+			fill := byte(0)
+			if tc.opts.LeaveHoles {
+				fill = 0xff
+			}
+			for _, r := range tc.expectedBad {
+				for offset := r.Offset; offset < r.End(); offset++ {
+					expected[offset] = fill
+				}
+			}
+			if !bytes.Equal(out.data, expected) {
+				t.Errorf("got content %v, expected %v", out.data, expected)
+			}
+		})
+	}
+}
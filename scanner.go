@@ -6,7 +6,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/facebookincubator/go-belt/tool/logger"
 	"github.com/facebookincubator/go-belt/tool/logger/implementation/zap"
@@ -18,6 +20,17 @@ type dirScanner struct {
 	fileTree *fileTree
 	rootPath string
 	maxDepth uint
+
+	// dirID is the device and the inode of the directory taken from
+	// the listing of its parent, to not lstat every directory (nil means
+	// unknown, the directory is lstat-ed then). It is replaced by the one
+	// from lstat if the directory is lstat-ed anyway.
+	dirID *inodeID
+
+	// cacheFailed means some entries of the directory were not stored to
+	// the cache, thus the directory is not marked as listed there (and is
+	// listed again if the scan is resumed)
+	cacheFailed bool
 }
 
 func newDirScanner(ft *fileTree, rootPath string, maxDepth uint) *dirScanner {
@@ -38,7 +51,8 @@ func (s *dirScanner) startScanning() {
 		defer s.fileTree.scanWg.Done()
 		err := s.scanRootDir()
 		if err != nil {
-			s.fileTree.addBrokenFile(s.fileTree.rootPath, err)
+			s.fileTree.addBrokenFile(s.rootPath, withPhase(BrokenFilePhaseScan, err))
+			s.fileTree.markDirIncomplete(s.rootPath)
 		}
 	}()
 }
@@ -56,7 +70,35 @@ func (s *dirScanner) scanRootDir() error {
 	log.Println("scanning dir", s.rootPath, "with maxDepth", s.maxDepth)
 	defer log.Println("/scanning dir", s.rootPath, "with maxDepth", s.maxDepth)
 
-	nameCh, errCh, err := osrecovery.List(ctx, s.rootPath)
+	lstat := os.Lstat
+	if s.fileTree.scanOptions.IsolatedLstat {
+		stater := osrecovery.NewStater(ctx, osrecovery.StatOptions{
+			Timeout: s.fileTree.scanOptions.LstatTimeout,
+		})
+		defer stater.Close()
+		lstat = stater.Lstat
+	}
+
+	var dirInfo os.FileInfo
+	if s.dirID == nil || s.fileTree.cacheDB != nil {
+		// the times of the directory are also needed for the cache (see cacheDirListed)
+		var err error
+		dirInfo, err = lstat(s.rootPath)
+		if err != nil {
+			return err
+		}
+		if stat, ok := dirInfo.Sys().(*syscall.Stat_t); ok {
+			s.dirID = &inodeID{dev: uint64(stat.Dev), ino: stat.Ino}
+		}
+	}
+	if s.dirID != nil {
+		if prevPath, visited := s.fileTree.markDirVisited(*s.dirID, s.rootPath); visited {
+			log.Println("got into a directory cycle:", s.rootPath, "is", prevPath)
+			return fmt.Errorf("%w: '%s' is the same directory as '%s'", ErrDirectoryCycle, s.rootPath, prevPath)
+		}
+	}
+
+	entryCh, errCh, err := osrecovery.List(ctx, s.rootPath, s.fileTree.scanOptions.List)
 	if err != nil {
 		return errors.New(err)
 	}
@@ -68,56 +110,214 @@ func (s *dirScanner) scanRootDir() error {
 		for err := range errCh {
 			err = fmt.Errorf("got error in '%s': %w", s.rootPath, err)
 			log.Println(err)
-			s.fileTree.addBrokenFile(s.rootPath, err)
+			s.fileTree.addBrokenFile(s.rootPath, withPhase(BrokenFilePhaseScan, err))
+			s.fileTree.markDirIncomplete(s.rootPath)
 		}
 	}()
 
-	for fileName := range nameCh {
-		if fileName == "." || fileName == ".." {
+	for entry := range entryCh {
+		if entry.Name == "." || entry.Name == ".." {
 			continue
 		}
-		filePath := filepath.Join(s.rootPath, fileName)
-		fileInfo, err := os.Lstat(filePath)
+		filePath := filepath.Join(s.rootPath, entry.Name)
+		pathRel, err := filepath.Rel(s.fileTree.rootPath, filePath)
+		if err != nil {
+			return errors.New(err)
+		}
+
+		if entry.Type != osrecovery.DirEntryTypeUnknown && s.fileTree.scanOptions.Filter.IsExcluded(pathRel, entry.Type == osrecovery.DirEntryTypeDirectory) {
+			continue
+		}
+
+		if entry.Type == osrecovery.DirEntryTypeDirectory {
+			// no need to lstat a directory, it is enough to know it is a directory
+			var subDirID *inodeID
+			if s.dirID != nil && !s.fileTree.isPossibleMountPoint(pathRel) {
+				// d_ino is on the same device, unless it is a mount point
+				// (which is lstat-ed then to get the device)
+				subDirID = &inodeID{dev: s.dirID.dev, ino: entry.Inode}
+			}
+			s.scanSubDir(filePath, subDirID)
+			continue
+		}
+
+		fileInfo, err := lstat(filePath)
 		//log.Println("fileInfo:", filePath, fileInfo)
 		if err != nil {
+			s.fileTree.markDirIncomplete(s.rootPath)
+			err = withPhase(BrokenFilePhaseLstat, err)
 			if added, _ := s.fileTree.addBrokenFile(filePath, err); !added {
 				// this path was already marked, thus we got into a loop, breaking it
-				s.fileTree.addBrokenFile(s.rootPath, err)
+				s.fileTree.addBrokenFile(s.rootPath, withPhase(BrokenFilePhaseScan, fmt.Errorf("%w: %v", ErrGetdentsLoop, err)))
 				log.Println("got into a loop (case #0):", err)
 				return nil
 			}
 			continue
 		}
 
-		if fileInfo.IsDir() {
-			if s.maxDepth == 1 {
-				continue
-			}
-			nextDepth := s.maxDepth
-			if nextDepth != 0 {
-				nextDepth--
-			}
-
-			s := newDirScanner(s.fileTree, filePath, nextDepth)
-			s.Start()
+		if entry.Type == osrecovery.DirEntryTypeUnknown && s.fileTree.scanOptions.Filter.IsExcluded(pathRel, fileInfo.IsDir()) {
 			continue
 		}
 
-		pathRel, err := filepath.Rel(s.fileTree.rootPath, filePath)
-		if err != nil {
-			return errors.New(err)
+		if fileInfo.IsDir() {
+			// d_type was not reported by the filesystem (DT_UNKNOWN)
+			var subDirID *inodeID
+			if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+				subDirID = &inodeID{dev: uint64(stat.Dev), ino: stat.Ino}
+			}
+			s.scanSubDir(filePath, subDirID)
+			continue
 		}
-		s.fileTree.nodeMapMutex.Lock()
-		_, alreadySet := s.fileTree.nodeMap[pathRel]
-		s.fileTree.nodeMapMutex.Unlock()
+		_, alreadySet := s.fileTree.getNode(pathRel)
 		if alreadySet {
-			s.fileTree.addBrokenFile(s.rootPath, fmt.Errorf("got into a cycle getdents in '%s'", s.rootPath))
+			s.fileTree.markDirIncomplete(s.rootPath)
+			s.fileTree.addBrokenFile(s.rootPath, withPhase(BrokenFilePhaseScan, fmt.Errorf("%w in '%s'", ErrGetdentsLoop, s.rootPath)))
 			log.Println("got into a loop (case #1):", s.rootPath, pathRel)
 			continue
 		}
-		s.fileTree.addNode(node{path: pathRel, size: fileInfo.Size()})
+		if err := s.fileTree.addNode(newNode(pathRel, fileInfo)); err != nil {
+			log.Println(err)
+			s.cacheFailed = true
+		}
 	}
 	wg.Wait()
+	s.fileTree.markDirListed(s.rootPath)
+	if s.fileTree.cacheDB != nil {
+		if s.cacheFailed {
+			log.Println("not marking", s.rootPath, "as listed in the cache: some of its entries are not stored there")
+		} else if err := s.fileTree.cacheDirListed(s.rootPath, dirInfo, s.fileTree.isDirKnownComplete(s.fileTree.relPath(s.rootPath))); err != nil {
+			log.Println(err)
+		}
+	}
 
 	return nil
 }
+
+func (s *dirScanner) scanSubDir(dirPath string, dirID *inodeID) {
+	if err := s.fileTree.cacheDirFound(dirPath); err != nil {
+		log.Println(err)
+		s.cacheFailed = true
+	}
+	if s.fileTree.isDirCachedListed(dirPath) {
+		// the entries are read from the cache, and the directory is already
+		// marked as listed or incomplete (see rescan)
+		return
+	}
+	if s.maxDepth == 1 {
+		s.fileTree.markDirIncomplete(dirPath)
+		return
+	}
+	nextDepth := s.maxDepth
+	if nextDepth != 0 {
+		nextDepth--
+	}
+
+	subDirScanner := newDirScanner(s.fileTree, dirPath, nextDepth)
+	subDirScanner.dirID = dirID
+	subDirScanner.Start()
+}
+
+// inodeID identifies a file (or a directory) regardless of the path it was reached by.
+type inodeID struct {
+	dev uint64
+	ino uint64
+}
+
+// markDirVisited remembers the directory as entered. If it was already
+// entered, then it returns the path it was entered by the first time.
+func (ft *fileTree) markDirVisited(id inodeID, dirPath string) (string, bool) {
+	ft.visitedDirsLocker.Lock()
+	defer ft.visitedDirsLocker.Unlock()
+	if ft.visitedDirs == nil {
+		ft.visitedDirs = map[inodeID]string{}
+	}
+	if prevPath, ok := ft.visitedDirs[id]; ok {
+		return prevPath, true
+	}
+	ft.visitedDirs[id] = dirPath
+	return "", false
+}
+
+// isPossibleMountPoint returns false if the directory (relative to
+// the root) is known to be not a mount point, thus its device is the same
+// as the one of its parent.
+func (ft *fileTree) isPossibleMountPoint(pathRel string) bool {
+	ft.mountPointsOnce.Do(func() {
+		mountPoints, err := ft.loadMountPoints()
+		if err != nil {
+			log.Println("unable to get the mount points, the directories will be lstat-ed:", err)
+			return
+		}
+		ft.mountPoints = mountPoints
+	})
+	if ft.mountPoints == nil {
+		return true
+	}
+	_, ok := ft.mountPoints[pathRel]
+	return ok
+}
+
+// loadMountPoints returns the mount points under the root (relative to it).
+func (ft *fileTree) loadMountPoints() (map[string]struct{}, error) {
+	rootPath, err := filepath.Abs(ft.rootPath)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err = filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]struct{}{}
+	for _, mountPoint := range parseMountInfo(string(mountInfo)) {
+		rel, err := filepath.Rel(rootPath, mountPoint)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		mountPoints[rel] = struct{}{}
+	}
+	return mountPoints, nil
+}
+
+// parseMountInfo returns the mount points listed in /proc/self/mountinfo.
+func parseMountInfo(mountInfo string) []string {
+	var result []string
+	for _, line := range strings.Split(mountInfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		result = append(result, unescapeMountInfo(fields[4]))
+	}
+	return result
+}
+
+// unescapeMountInfo decodes the octal escapes (like "\040" for a space)
+// of a path in /proc/self/mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var result strings.Builder
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] == '\\' && idx+4 <= len(s) && isOctalDigits(s[idx+1:idx+4]) {
+			result.WriteByte((s[idx+1]-'0')<<6 | (s[idx+2]-'0')<<3 | (s[idx+3] - '0'))
+			idx += 3
+			continue
+		}
+		result.WriteByte(s[idx])
+	}
+	return result.String()
+}
+
+func isOctalDigits(s string) bool {
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] < '0' || s[idx] > '7' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package slowsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:21 / /proc rw,nosuid shared:2 - proc proc rw
+24 22 8:2 / /mnt/with\040space rw - ext4 /dev/sda2 rw
+25 22 8:3 /sub /mnt/back\134slash rw - ext4 /dev/sda3 rw
+broken line
+`
+	expected := []string{"/", "/proc", "/mnt/with space", `/mnt/back\slash`}
+	if mountPoints := parseMountInfo(mountInfo); !reflect.DeepEqual(mountPoints, expected) {
+		t.Errorf("got %q, expected %q", mountPoints, expected)
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	for escaped, expected := range map[string]string{
+		`/a`:         "/a",
+		`/a\040b`:    "/a b",
+		`/a\011\012`: "/a\t\n",
+		`/a\04`:      `/a\04`,
+		`/a\089`:     `/a\089`,
+	} {
+		if unescaped := unescapeMountInfo(escaped); unescaped != expected {
+			t.Errorf("unescapeMountInfo(%q) = %q, expected %q", escaped, unescaped, expected)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package slowsync
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/xaionaro-go/slowsync/pkg/osrecovery"
+)
+
+// sourceFile is a file opened for reading either directly or
+// via an osrecovery helper process.
+type sourceFile interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+type osSourceFile struct {
+	*os.File
+	size int64
+}
+
+func (f osSourceFile) Size() int64 {
+	return f.size
+}
+
+// SetIsolatedReads makes the file contents to be read by helper processes,
+// which are killed if a read takes longer than readTimeout (zero means
+// no timeout). Thus a read stuck in the uninterruptible sleep does
+// not block the sync forever.
+func (ft *fileTree) SetIsolatedReads(readTimeout time.Duration) {
+	ft.isolatedReads = &osrecovery.OpenOptions{
+		Timeout: readTimeout,
+	}
+}
+
+func (ft *fileTree) openSourceFile(filePath string) (sourceFile, error) {
+	if ft.isolatedReads != nil {
+		return osrecovery.Open(context.Background(), filePath, *ft.isolatedReads)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return osSourceFile{File: f, size: fi.Size()}, nil
+}
+
+// newSequentialReader returns a reader of the whole file, up to EOF.
+func newSequentialReader(f sourceFile) io.Reader {
+	return io.NewSectionReader(f, 0, math.MaxInt64)
+}